@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// DefaultAPIKeyHeader is the header API keys are read from unless configured otherwise
+const DefaultAPIKeyHeader = "X-API-Key"
+
+// APIKeyStore looks up API keys by their hash, see HashAPIKey. Stores never need to hold the keys themselves.
+type APIKeyStore interface {
+	// LookupAPIKey returns the Authentication granted to the key with the given hash. Unknown keys are reported
+	// with an error matching ErrInvalidCredentials; any other error is treated as an internal failure.
+	LookupAPIKey(ctx context.Context, keyHash string) (*Authentication, error)
+}
+
+// APIKeyAuthenticator authenticates callers which can't handle JWTs through a static key sent as header. The
+// Authentication of a key carries its configured authorities, so that HasAnyRole and the other middleware work
+// exactly as for JWT callers.
+type APIKeyAuthenticator struct {
+	Middleware
+
+	store APIKeyStore
+	// header the key is read from, DefaultAPIKeyHeader if empty
+	Header string
+}
+
+// NewAPIKeyAuthenticator creates an APIKeyAuthenticator reading keys from the DefaultAPIKeyHeader
+func NewAPIKeyAuthenticator(store APIKeyStore) *APIKeyAuthenticator {
+	authenticator := &APIKeyAuthenticator{
+		store:  store,
+		Header: DefaultAPIKeyHeader,
+	}
+	authenticator.Middleware = NewMiddleware(authenticator)
+	return authenticator
+}
+
+// FromRequest resolves the API key header of the request. A missing header matches ErrTokenMissing, an unknown key
+// ErrInvalidCredentials.
+func (authenticator *APIKeyAuthenticator) FromRequest(r *http.Request) (*Authentication, error) {
+	header := authenticator.Header
+	if header == "" {
+		header = DefaultAPIKeyHeader
+	}
+	key := r.Header.Get(header)
+	if key == "" {
+		return nil, &Error{ErrorCode: TokenMissing, Cause: fmt.Errorf("no %s header", header)}
+	}
+
+	authentication, err := authenticator.store.LookupAPIKey(r.Context(), HashAPIKey(key))
+	if err == nil && authentication == nil {
+		err = ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	return authentication, nil
+}
+
+// GenerateAPIKey creates a random API key with 256 bits of entropy
+func GenerateAPIKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("unable to generate API key: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// HashAPIKey returns the hex encoded SHA-256 hash API keys are stored and looked up with. Unlike passwords, API keys
+// are random and long, so a fast hash does not make them guessable.
+func HashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// Chain combines authenticators, e.g. JWT cookies and API keys, into one. The first authenticator finding
+// credentials in the request decides; the others are only asked if it reports ErrTokenMissing.
+func Chain(authenticators ...Authenticator) Authenticator {
+	return chain(authenticators)
+}
+
+// InMemoryAPIKeys is an APIKeyStore for a fixed set of keys
+type InMemoryAPIKeys struct {
+	mutex sync.RWMutex
+	keys  map[string]Authentication
+}
+
+// NewInMemoryAPIKeys creates an empty InMemoryAPIKeys
+func NewInMemoryAPIKeys() *InMemoryAPIKeys {
+	return &InMemoryAPIKeys{keys: map[string]Authentication{}}
+}
+
+// Add grants the authentication to the given key
+func (store *InMemoryAPIKeys) Add(key string, authentication Authentication) {
+	store.AddHashed(HashAPIKey(key), authentication)
+}
+
+// AddHashed grants the authentication to the key with the given hash
+func (store *InMemoryAPIKeys) AddHashed(keyHash string, authentication Authentication) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.keys[keyHash] = authentication
+}
+
+func (store *InMemoryAPIKeys) LookupAPIKey(ctx context.Context, keyHash string) (*Authentication, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	authentication, found := store.keys[keyHash]
+	if !found {
+		return nil, ErrInvalidCredentials
+	}
+	return &authentication, nil
+}
+
+// --------------------------
+// private stuff
+// --------------------------
+
+type chain []Authenticator
+
+func (authenticators chain) FromRequest(r *http.Request) (*Authentication, error) {
+	err := error(&Error{ErrorCode: TokenMissing})
+	for _, authenticator := range authenticators {
+		var authentication *Authentication
+		authentication, err = authenticator.FromRequest(r)
+		if !errors.Is(err, ErrTokenMissing) {
+			return authentication, err
+		}
+	}
+	return nil, err
+}
+
+// Challenge lists the challenges of all chained authenticators which are Challengers
+func (authenticators chain) Challenge() string {
+	var challenges []string
+	for _, authenticator := range authenticators {
+		if challenger, ok := authenticator.(Challenger); ok && challenger.Challenge() != "" {
+			challenges = append(challenges, challenger.Challenge())
+		}
+	}
+	return strings.Join(challenges, ", ")
+}
+
+// logger is the one of the first chained authenticator, which usually is the service
+func (authenticators chain) logger() *slog.Logger {
+	if len(authenticators) == 0 {
+		return slog.Default()
+	}
+	return loggerOf(authenticators[0])
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+    "errors"
+    "net/http"
+    "testing"
+)
+
+const testAPIKey = "3q2-7wX9fJ4kPz0sLmN8vRtYbHcD1eGa"
+
+func newTestAPIKeyAuthenticator() *APIKeyAuthenticator {
+    keys := NewInMemoryAPIKeys()
+    keys.Add(testAPIKey, Authentication{
+        Subject:     "legacy-erp",
+        Authorities: []GrantedAuthority{{Role: "IMPORT"}},
+    })
+    return NewAPIKeyAuthenticator(keys)
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+    authenticator := newTestAPIKeyAuthenticator()
+
+    cases := map[string]struct {
+        key             string
+        expectedSubject string
+        expectedError   error
+    }{
+        "known key":   {key: testAPIKey, expectedSubject: "legacy-erp"},
+        "unknown key": {key: "guessed", expectedError: ErrInvalidCredentials},
+        "no key":      {key: "", expectedError: ErrTokenMissing},
+    }
+
+    for name, c := range cases {
+        req, _ := newRequestResponseEmulation(t)
+        req.Header.Set("X-API-Key", c.key)
+
+        authentication, err := authenticator.FromRequest(req)
+
+        if c.expectedError != nil && !errors.Is(err, c.expectedError) {
+            t.Errorf("%s: expected %v, got %v", name, c.expectedError, err)
+        }
+        if c.expectedError == nil && (err != nil || authentication.Subject != c.expectedSubject) {
+            t.Errorf("%s: unexpected authentication %v (%v)", name, authentication, err)
+        }
+    }
+}
+
+func TestAPIKeyMiddleware(t *testing.T) {
+    authenticator := newTestAPIKeyAuthenticator()
+
+    cases := map[string]struct {
+        role          string
+        expectedVisit bool
+    }{
+        "configured role": {role: "IMPORT", expectedVisit: true},
+        "other role":      {role: "ADMIN", expectedVisit: false},
+    }
+
+    for name, c := range cases {
+        nextHandler := &nextHandler{}
+        req, rr := newRequestResponseEmulation(t)
+        req.Header.Set("X-API-Key", testAPIKey)
+
+        authenticator.HasAnyRole(c.role)(nextHandler).ServeHTTP(rr, req)
+
+        if nextHandler.Visited != c.expectedVisit {
+            t.Errorf("%s: expected next handler visited to be %v", name, c.expectedVisit)
+        }
+    }
+}
+
+func TestChainOfJWTAndAPIKey(t *testing.T) {
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+        JWTCookieName: "JWT",
+    })
+    authenticator := Chain(authService, newTestAPIKeyAuthenticator())
+
+    cases := map[string]struct {
+        cookie        string
+        key           string
+        expectedError error
+    }{
+        "JWT cookie":         {cookie: tokenValidUntil2099},
+        "API key":            {key: testAPIKey},
+        "expired JWT cookie": {cookie: expiredToken, key: testAPIKey, expectedError: ErrTokenExpired},
+        "nothing":            {expectedError: ErrTokenMissing},
+    }
+
+    for name, c := range cases {
+        req, _ := newRequestResponseEmulation(t)
+        if c.cookie != "" {
+            req.AddCookie(&http.Cookie{Name: "JWT", Value: c.cookie})
+        }
+        if c.key != "" {
+            req.Header.Set("X-API-Key", c.key)
+        }
+
+        _, err := authenticator.FromRequest(req)
+
+        if (c.expectedError == nil && err != nil) || (c.expectedError != nil && !errors.Is(err, c.expectedError)) {
+            t.Errorf("%s: expected %v, got %v", name, c.expectedError, err)
+        }
+    }
+}
+
+func TestGeneratedAPIKeysDiffer(t *testing.T) {
+    first, err := GenerateAPIKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    second, _ := GenerateAPIKey()
+
+    if first == second || len(first) != 43 {
+        t.Errorf("Unexpected API keys %s and %s", first, second)
+    }
+}
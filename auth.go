@@ -1,105 +1,237 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/mitchellh/mapstructure"
+	"log/slog"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 // structure holding data for instantiation of Service
 type authService struct {
 	authConfig Config
+	// config swapped in by Reload, shared by all copies of the service
+	reloaded *atomic.Value
 }
 
-// New builds an authService instance given the config object
+// New builds an authService instance given the config object. The config is not validated; see NewService.
 func New(authConfig Config) authService {
 	return authService{
-		authConfig,
+		authConfig: authConfig,
+		reloaded:   &atomic.Value{},
 	}
 }
 
+// NewService builds an authService instance given the config object, after validating it
+func NewService(authConfig Config) (authService, error) {
+	if err := authConfig.Validate(); err != nil {
+		return authService{}, err
+	}
+	return New(authConfig), nil
+}
+
 // NewWithDefaults creates a new authService with a private key
 func NewWithDefaults(privateKey string) authService {
-	config := DefaultAuthConfig([]byte(privateKey))
-	return authService{
-		config,
+	return New(DefaultAuthConfig([]byte(privateKey)))
+}
+
+// Reload validates the config and swaps it in without restarting. Requests already being handled finish with the
+// former config; copies of the service, e.g. in middleware and handlers built before, use the new one as well.
+func (service authService) Reload(authConfig Config) error {
+	if service.reloaded == nil {
+		return errors.New("service has not been built by New")
+	}
+	if err := authConfig.Validate(); err != nil {
+		return err
 	}
+	service.reloaded.Store(authConfig)
+	return nil
 }
 
-// FromRequest from http.Request transforms a cookie in a request in an Authentication instance
+// FromRequest from http.Request transforms a cookie in a request in an Authentication instance. Without cookie,
+// the token is taken from an "Authorization: Bearer" header, as sent by machine callers. Errors match one of the
+// sentinel errors of this package, e.g. ErrTokenMissing if there is neither.
+//
+// Tokens bound to a client certificate are only accepted over a connection authenticated with that certificate,
+// tokens bound to a DPoP key only together with a valid DPoP proof.
 func (service authService) FromRequest(r *http.Request) (*Authentication, error) {
+	service = service.current()
+	var token string
 	if cookie, cookieError := r.Cookie(service.authConfig.JWTCookieName); cookieError != nil {
-		return nil, cookieError
+		if token = bearerToken(r); token == "" {
+			return nil, &Error{ErrorCode: TokenMissing, Cause: cookieError}
+		}
 	} else {
-		return service.FromCookie(cookie)
+		token = cookie.Value
 	}
-}
 
+	authentication, err := service.parseToken(token, "")
+	if authentication != nil {
+		if bindingError := service.verifyFingerprintRequired(authentication); bindingError != nil {
+			return nil, bindingError
+		}
+		if bindingError := service.verifyBinding(r, token, authentication); bindingError != nil {
+			return nil, bindingError
+		}
+	}
+	return authentication, err
+}
 
-// FromCookie transforms a JWT cookie back to an authentication
+// FromCookie transforms a JWT cookie back to an authentication. A token which is only expired still yields its
+// authentication, together with an error matching ErrTokenExpired.
+//
+// The binding of a token to a certificate, DPoP key or fingerprint can only be verified with the request, so bound
+// tokens, and with a Config.FingerprintCookieName all user tokens, are rejected with ErrBindingMismatch; use
+// FromRequest for them.
 func (service authService) FromCookie(cookie *http.Cookie) (*Authentication, error) {
-	token, err := jwt.Parse(cookie.Value, func(token *jwt.Token) (interface{}, error) {
-		// Don't forget to validate the alg is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	service = service.current()
+	authentication, err := service.parseToken(cookie.Value, "")
+	if authentication != nil {
+		if bindingError := service.verifyFingerprintRequired(authentication); bindingError != nil {
+			return nil, bindingError
 		}
+		if bindingError := verifyUnbound(authentication); bindingError != nil {
+			return nil, bindingError
+		}
+	}
+	return authentication, err
+}
 
-		return service.authConfig.JWTPrivateKey, nil
-	})
+// parseToken transforms a signed JWT back to an authentication, given the expected token use ("" for regular
+// tokens). Tokens meant for another use, e.g. MFA pending tokens, are rejected.
+func (service authService) parseToken(signedString string, use string) (*Authentication, error) {
+	token, err := service.parseSigned(signedString)
+	if token == nil {
+		return nil, fromValidationError(err)
+	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return service.constructAuthentication(claims)
-	} else {
-		if validationError, ok := err.(*jwt.ValidationError); ok {
-			// if we have only a validation expired error, we allow the token to be generated
-			if validationError.Errors == jwt.ValidationErrorExpired {
-				authentication, conversionError := service.constructAuthentication(claims)
-				if conversionError != nil {
-					return nil, conversionError
-				}
-				return authentication, validationError
-			}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, fromValidationError(err)
+	}
+
+	if tokenUse := toString(claims["token_use"]); tokenUse != use {
+		if tokenUse == tokenUseMFAPending {
+			return nil, ErrMFARequired
+		}
+		return nil, &Error{ErrorCode: TokenMalformed, Cause: fmt.Errorf("unexpected token use %q", tokenUse)}
+	}
+
+	var authError *Error
+	if !token.Valid {
+		authError = fromValidationError(err)
+		// if we have only a validation expired error, we allow the token to be generated
+		if authError.ErrorCode != TokenExpired {
+			return nil, authError
 		}
+	}
+
+	authentication, conversionError := service.constructAuthentication(claims)
+	if conversionError != nil {
+		return nil, &Error{ErrorCode: TokenMalformed, Cause: conversionError}
+	}
+	if err := service.verifyAuthentication(authentication); err != nil {
 		return nil, err
 	}
+	if authError != nil {
+		return authentication, authError
+	}
+	return authentication, nil
 }
 
-// ToJWTCookie transforms and Authentication into a Cookie
+// ToJWTCookie transforms and Authentication into a Cookie. Signing errors are not reported; use IssueCookie to
+// get hold of them. With a Config.FingerprintCookieName, the fingerprint cookie has to be set as well, which only
+// IssueCookies returns: authentications which are not bound to a fingerprint yet yield an empty cookie here, which
+// is logged at warn level.
 func (service authService) ToJWTCookie(authentication *Authentication) *http.Cookie {
-	type JWTToken struct {
-		jwt.StandardClaims
-		Name        string             `json:"name,omitempty"`
-		Username    string             `json:"username,omitempty"`
-		Authorities []GrantedAuthority `json:"authorities,omitempty"`
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, JWTToken{
-		jwt.StandardClaims{
-			Issuer:    authentication.Issuer,
-			IssuedAt:  authentication.IssuedAt,
-			Subject:   authentication.Subject,
-			ExpiresAt: authentication.ExpiresAt,
-		},
-		authentication.Name,
-		authentication.Username,
-		authentication.Authorities,
-	})
+	service = service.current()
+	if err := service.verifyFingerprintRequired(authentication); err != nil {
+		service.logger().Warn("Unable to issue token cookie; use IssueCookies to bind it to a fingerprint",
+			"subject", authentication.Subject, "error", err)
+		return service.jwtCookie("")
+	}
+	signedString, _ := service.sign(authentication)
 
-	signedString, _ := token.SignedString(service.authConfig.JWTPrivateKey)
+	return service.jwtCookie(signedString)
+}
 
-	return &http.Cookie{
-		Name:     service.authConfig.JWTCookieName,
-		Path:     "/",
-		HttpOnly: true,
-		MaxAge:   60 * 60 * 24 * 30, // one month valid TODO: configurable
-		Value:    signedString,
+// IssueCookie transforms an Authentication into a Cookie, failing if the key is missing, an extra claim uses a
+// reserved name or the token can not be signed. With a Config.FingerprintCookieName, it also fails with
+// ErrBindingMismatch, logged at warn level, for authentications which are not bound to a fingerprint yet; use
+// IssueCookies to bind them. Authentications refreshed by RefreshAuthentication keep the binding of their token.
+func (service authService) IssueCookie(authentication *Authentication) (*http.Cookie, error) {
+	service = service.current()
+	if len(service.authConfig.JWTPrivateKey) == 0 {
+		return nil, &ConfigError{Problems: []string{"jwtPrivateKey must not be empty"}}
 	}
+	if err := service.verifyFingerprintRequired(authentication); err != nil {
+		service.logger().Warn("Unable to issue token cookie; use IssueCookies to bind it to a fingerprint",
+			"subject", authentication.Subject, "error", err)
+		return nil, err
+	}
+	for name := range authentication.Extra {
+		if IsReservedClaim(name) {
+			return nil, fmt.Errorf("extra claim %q uses a reserved claim name", name)
+		}
+	}
+
+	signedString, err := service.sign(authentication)
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign token: %w", err)
+	}
+
+	return service.jwtCookie(signedString), nil
+}
+
+// IssueCookies transforms an Authentication into the cookies to set, like IssueCookie. With a
+// Config.FingerprintCookieName, the token is bound to a fresh random fingerprint, which is returned as second,
+// hardened cookie.
+func (service authService) IssueCookies(authentication *Authentication) ([]*http.Cookie, error) {
+	service = service.current()
+	if service.authConfig.FingerprintCookieName == "" {
+		cookie, err := service.IssueCookie(authentication)
+		if err != nil {
+			return nil, err
+		}
+		return []*http.Cookie{cookie}, nil
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return nil, fmt.Errorf("unable to generate fingerprint: %w", err)
+	}
+	fingerprint := hex.EncodeToString(random)
+
+	bound := *authentication
+	confirmation := Confirmation{}
+	if authentication.Confirmation != nil {
+		confirmation = *authentication.Confirmation
+	}
+	confirmation.Fingerprint = hashFingerprint(fingerprint)
+	bound.Confirmation = &confirmation
+
+	cookie, err := service.IssueCookie(&bound)
+	if err != nil {
+		return nil, err
+	}
+	fingerprintCookie := service.fingerprintCookie()
+	fingerprintCookie.Value = fingerprint
+	fingerprintCookie.MaxAge = cookie.MaxAge
+	return []*http.Cookie{cookie, fingerprintCookie}, nil
 }
 
 // GetClearedJWTCookie gets a blank cookie with a name corresponding to the provided config
 func (service authService) GetClearedJWTCookie() *http.Cookie {
+	service = service.current()
 	return &http.Cookie{
 		Name:     service.authConfig.JWTCookieName,
 		Path:     "/",
@@ -110,8 +242,28 @@ func (service authService) GetClearedJWTCookie() *http.Cookie {
 	}
 }
 
+// IssueServiceToken issues a token for a machine caller, carrying the client ID and the granted scopes but no user.
+// Like client credentials tokens of OAuth servers, the client is its own subject (RFC 9068, section 2.2). The token
+// is meant to be sent as "Authorization: Bearer" header.
+func (service authService) IssueServiceToken(clientID string, scopes []string) (string, error) {
+	service = service.current()
+	if clientID == "" {
+		return "", errors.New("client ID must not be empty")
+	}
+	now := time.Now().In(time.UTC).Unix()
+	return service.sign(&Authentication{
+		Issuer:    service.authConfig.Issuer,
+		IssuedAt:  now,
+		ExpiresAt: now + service.authConfig.TokenExpiresIn,
+		Subject:   clientID,
+		ClientID:  clientID,
+		Scope:     strings.Join(scopes, " "),
+	})
+}
+
 // RefreshAuthentication refreshes Authentication expiracy date
 func (service authService) RefreshAuthentication(oldAuth *Authentication) (*Authentication, error) {
+	service = service.current()
 	var refreshedAuth Authentication
 	now := time.Now().In(time.UTC).Unix()
 
@@ -130,11 +282,37 @@ func (service authService) RefreshAuthentication(oldAuth *Authentication) (*Auth
 // private stuff
 // --------------------------
 
+// current returns the service with the config last swapped in by Reload. Entry points take it once, so that a
+// request is handled with a single config throughout.
+func (service authService) current() authService {
+	if service.reloaded != nil {
+		if authConfig, ok := service.reloaded.Load().(Config); ok {
+			service.authConfig = authConfig
+		}
+	}
+	return service
+}
+
+// logger returns the logger of the config, or the default one
+func (service authService) logger() *slog.Logger {
+	if logger := service.current().authConfig.Logger; logger != nil {
+		return logger
+	}
+	return slog.Default()
+}
+
 // constructAuthentication: from the claims of a jwt, create an authentication, or error if claims are not decodable
 func (service authService) constructAuthentication(claims jwt.MapClaims) (*Authentication, error) {
 	var auth Authentication
-	// converts inner maps so that we don't have to
-	error := mapstructure.Decode(claims, &auth)
+	// converts inner maps so that we don't have to. Only the claims named like their fields are decoded, as the
+	// field names are matched case insensitively and extra claims like "subject" would end up in them otherwise.
+	decoded := map[string]interface{}{}
+	for _, name := range []string{"name", "username", "authorities"} {
+		if value, found := claims[name]; found {
+			decoded[name] = value
+		}
+	}
+	error := mapstructure.Decode(decoded, &auth)
 	if error != nil {
 		return nil, error
 	}
@@ -143,11 +321,149 @@ func (service authService) constructAuthentication(claims jwt.MapClaims) (*Authe
 	auth.ExpiresAt = int64(toFloat64(claims["exp"]))
 	auth.Subject = toString(claims["sub"])
 	auth.Issuer = toString(claims["iss"])
+	auth.NotBefore = int64(toFloat64(claims["nbf"]))
+	auth.ID = toString(claims["jti"])
+	// aud may be a single string or a list (RFC 7519, section 4.1.3)
+	auth.Audience = toAudiences(claims["aud"])
+	if auth.Audience == nil && claims["aud"] != nil {
+		return nil, errors.New("aud claim must be a string or a list of strings")
+	}
+	auth.AuthenticationMethods = toStrings(claims["amr"])
+	auth.AuthenticationContextClass = toString(claims["acr"])
+	auth.AuthTime = int64(toFloat64(claims["auth_time"]))
+	auth.ClientID = toString(claims["client_id"])
+	auth.Scope = toString(claims["scope"])
+	if cnf, ok := claims["cnf"].(map[string]interface{}); ok {
+		auth.Confirmation = &Confirmation{
+			CertificateThumbprint: toString(cnf["x5t#S256"]),
+			KeyThumbprint:         toString(cnf["jkt"]),
+			Fingerprint:           toString(cnf["fgp"]),
+		}
+	}
+	auth.Extra = extraClaims(claims)
+
+	if service.authConfig.ClaimMapping != nil {
+		mapped, err := service.authConfig.ClaimMapping.Apply(claims)
+		if err != nil {
+			return nil, err
+		}
+		auth.Authorities = mergeAuthorities(auth.Authorities, mapped)
+	}
 
 	return &auth, nil
 
 }
 
+// verifyAuthentication checks an authentication against the issuer and revocations configured
+func (service authService) verifyAuthentication(authentication *Authentication) error {
+	if service.authConfig.VerifyIssuer && authentication.Issuer != service.authConfig.Issuer {
+		return &Error{
+			ErrorCode: IssuerMismatch,
+			Cause:     fmt.Errorf("expected %q, got %q", service.authConfig.Issuer, authentication.Issuer),
+		}
+	}
+	if service.authConfig.Revocations != nil {
+		revoked, err := service.authConfig.Revocations.IsRevoked(authentication)
+		if err != nil {
+			return fmt.Errorf("unable to check revocation: %w", err)
+		}
+		if revoked {
+			return ErrRevoked
+		}
+	}
+	return nil
+}
+
+// sign signs the claims of an authentication into a JWT, issued by the configured issuer unless it names one
+func (service authService) sign(authentication *Authentication) (string, error) {
+	claims := newJWTToken(authentication)
+	if claims.Issuer == "" {
+		claims.Issuer = service.authConfig.Issuer
+	}
+	return service.signToken(claims)
+}
+
+func (service authService) signToken(claims jwtToken) (string, error) {
+	if len(service.authConfig.JWTPrivateKey) == 0 {
+		return "", &ConfigError{Problems: []string{"jwtPrivateKey must not be empty"}}
+	}
+	entry := service.signingEntry()
+	method, key, err := entry.signingKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(method, claims)
+	if entry.KeyID != "" {
+		token.Header["kid"] = entry.KeyID
+	}
+	return token.SignedString(key)
+}
+
+// parseSigned parses a JWT, trying each key it may have been signed with until the signature matches
+func (service authService) parseSigned(signedString string) (*jwt.Token, error) {
+	var keyID string
+	if unverified, _, err := new(jwt.Parser).ParseUnverified(signedString, jwt.MapClaims{}); err == nil {
+		keyID, _ = unverified.Header["kid"].(string)
+	}
+	keys := service.verificationKeys(keyID, time.Now())
+	if len(keys) == 0 {
+		return nil, jwt.NewValidationError(fmt.Sprintf("key %s has been retired", keyID), jwt.ValidationErrorUnverifiable)
+	}
+
+	var token *jwt.Token
+	var err error
+	for _, key := range keys {
+		// the key validates that the alg is what we expect
+		token, err = jwt.Parse(signedString, key.verificationKey)
+		validationError, ok := err.(*jwt.ValidationError)
+		if !ok || validationError.Errors&jwt.ValidationErrorSignatureInvalid == 0 {
+			break
+		}
+	}
+	return token, err
+}
+
+// jwtCookie wraps a signed token in a cookie named according to the config
+func (service authService) jwtCookie(signedString string) *http.Cookie {
+	return &http.Cookie{
+		Name:     service.authConfig.JWTCookieName,
+		Path:     "/",
+		HttpOnly: true,
+		MaxAge:   60 * 60 * 24 * 30, // one month valid TODO: configurable
+		Value:    signedString,
+	}
+}
+
+// fingerprintCookie is the hardened cookie holding the fingerprint, which scripts can't read and browsers only send
+// to the site over TLS
+func (service authService) fingerprintCookie() *http.Cookie {
+	return &http.Cookie{
+		Name:     service.authConfig.FingerprintCookieName,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// mergeAuthorities adds authorities, merging the org units of roles which are already present
+func mergeAuthorities(authorities []GrantedAuthority, additional []GrantedAuthority) []GrantedAuthority {
+	for _, authority := range additional {
+		merged := false
+		for i := range authorities {
+			if authorities[i].Role == authority.Role {
+				authorities[i].OrgUnits = appendOrgUnits(authorities[i].OrgUnits, authority.OrgUnits...)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			authorities = append(authorities, authority)
+		}
+	}
+	return authorities
+}
+
 func toString(aString interface{}) string {
 	if s, ok := aString.(string); ok {
 		return s
@@ -155,9 +471,99 @@ func toString(aString interface{}) string {
 	return ""
 }
 
+func toStrings(someStrings interface{}) []string {
+	values, ok := someStrings.([]interface{})
+	if !ok {
+		return nil
+	}
+	converted := make([]string, 0, len(values))
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			converted = append(converted, s)
+		}
+	}
+	return converted
+}
+
+// toAudiences reads the aud claim, which may be a single string or a list of strings
+func toAudiences(aud interface{}) []string {
+	if audience, ok := aud.(string); ok {
+		return []string{audience}
+	}
+	return toStrings(aud)
+}
+
 func toFloat64(aNumber interface{}) float64 {
 	if convertedNumb, ok := aNumber.(float64); ok {
 		return convertedNumb
 	}
 	return 0
 }
+
+// verifyBinding checks that the client proves possession of the certificate, DPoP key or fingerprint a token is bound
+// to
+func (service authService) verifyBinding(r *http.Request, token string, authentication *Authentication) error {
+	confirmation := authentication.Confirmation
+	if confirmation == nil {
+		return nil
+	}
+
+	if confirmation.CertificateThumbprint != "" {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return &Error{ErrorCode: BindingMismatch, Cause: errors.New("no client certificate")}
+		}
+		thumbprint := CertificateThumbprint(r.TLS.PeerCertificates[0])
+		if subtle.ConstantTimeCompare([]byte(thumbprint), []byte(confirmation.CertificateThumbprint)) != 1 {
+			return ErrBindingMismatch
+		}
+	}
+
+	if confirmation.KeyThumbprint != "" {
+		if service.authConfig.DPoP == nil {
+			return &Error{ErrorCode: BindingMismatch, Cause: errors.New("DPoP proofs are not supported")}
+		}
+		thumbprint, err := service.authConfig.DPoP.VerifyProof(r, token)
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare([]byte(thumbprint), []byte(confirmation.KeyThumbprint)) != 1 {
+			return ErrBindingMismatch
+		}
+	}
+
+	if confirmation.Fingerprint != "" {
+		cookie, err := r.Cookie(service.authConfig.FingerprintCookieName)
+		if service.authConfig.FingerprintCookieName == "" || err != nil {
+			return &Error{ErrorCode: BindingMismatch, Cause: errors.New("fingerprint cookie missing")}
+		}
+		if subtle.ConstantTimeCompare([]byte(hashFingerprint(cookie.Value)), []byte(confirmation.Fingerprint)) != 1 {
+			return ErrBindingMismatch
+		}
+	}
+	return nil
+}
+
+// verifyFingerprintRequired rejects user tokens which are not bound to a fingerprint while a fingerprint cookie is
+// configured. Service tokens are sent as bearer tokens by machine callers and need no fingerprint.
+func (service authService) verifyFingerprintRequired(authentication *Authentication) error {
+	if service.authConfig.FingerprintCookieName == "" || authentication.IsServiceAccount() {
+		return nil
+	}
+	if authentication.Confirmation == nil || authentication.Confirmation.Fingerprint == "" {
+		return &Error{ErrorCode: BindingMismatch, Cause: errors.New("token not bound to a fingerprint")}
+	}
+	return nil
+}
+
+// verifyUnbound rejects tokens whose binding can not be verified for lack of a request
+func verifyUnbound(authentication *Authentication) error {
+	if authentication.Confirmation != nil && *authentication.Confirmation != (Confirmation{}) {
+		return &Error{ErrorCode: BindingMismatch, Cause: errors.New("bound token can only be verified with the request")}
+	}
+	return nil
+}
+
+func hashFingerprint(fingerprint string) string {
+	hash := sha256.Sum256([]byte(fingerprint))
+	return hex.EncodeToString(hash[:])
+}
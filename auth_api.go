@@ -1,7 +1,10 @@
 package auth
 
 import (
+	"encoding/json"
 	"net/http"
+	"strings"
+	"time"
 )
 
 type OrganizationalUnit struct {
@@ -16,18 +19,137 @@ type GrantedAuthority struct {
 
 type Authentication struct {
 	//jwt.StandardClaims
-	ExpiresAt   int64              `json:"exp,omitempty"`
-	IssuedAt    int64              `json:"iat,omitempty"`
+	ExpiresAt int64 `json:"exp,omitempty"`
+	IssuedAt  int64 `json:"iat,omitempty"`
+	// token is not accepted before this unix timestamp
+	NotBefore   int64              `json:"nbf,omitempty"`
+	ID          string             `json:"jti,omitempty"`
+	Audience    Audiences          `json:"aud,omitempty"`
 	Issuer      string             `json:"iss,omitempty"`
 	Subject     string             `json:"sub,omitempty"`
 	Name        string             `json:"name,omitempty"`
 	Username    string             `json:"username,omitempty"`
 	Authorities []GrantedAuthority `json:"authorities,omitempty"`
+	// methods used to authenticate, e.g. AMRPassword and AMROneTimePassword (RFC 8176)
+	AuthenticationMethods []string `json:"amr,omitempty"`
+	// assurance level of the authentication, e.g. ACRSingleFactor or ACRMultiFactor
+	AuthenticationContextClass string `json:"acr,omitempty"`
+	// client a service account token has been issued to; see IssueServiceToken
+	ClientID string `json:"client_id,omitempty"`
+	// space separated scopes granted to the token
+	Scope string `json:"scope,omitempty"`
+	// key or certificate the token is bound to; see ClientCertAuthenticator and DPoPVerifier
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+	// unix timestamp of the login; unlike IssuedAt and ExpiresAt it is not touched by refreshes
+	AuthTime int64 `json:"auth_time,omitempty"`
+	// custom claims carried in the token next to the known ones. Names of the known claims are reserved (see
+	// IsReservedClaim) and are ignored here. Values are decoded from JSON, so numbers come back as float64.
+	Extra map[string]interface{} `json:"extra,omitempty" mapstructure:"-"`
+}
+
+// Audiences are the recipients a token is intended for (RFC 7519, section 4.1.3). A single audience is encoded as
+// string, several ones as list; both are accepted when decoding.
+type Audiences []string
+
+func (audiences Audiences) MarshalJSON() ([]byte, error) {
+	if len(audiences) == 1 {
+		return json.Marshal(audiences[0])
+	}
+	return json.Marshal([]string(audiences))
+}
+
+func (audiences *Audiences) UnmarshalJSON(data []byte) error {
+	var audience string
+	if err := json.Unmarshal(data, &audience); err == nil {
+		*audiences = Audiences{audience}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(audiences))
+}
+
+// Authentication method references (RFC 8176) recorded during login
+const (
+	AMRPassword        = "pwd"
+	AMROneTimePassword = "otp"
+	AMRMultiFactor     = "mfa"
+)
+
+// Authentication context classes recorded during login, after the authenticator assurance levels of NIST 800-63B
+const (
+	ACRSingleFactor = "aal1"
+	ACRMultiFactor  = "aal2"
+)
+
+// HasAuthenticationMethod tells if the given method has been used to authenticate
+func (authentication *Authentication) HasAuthenticationMethod(method string) bool {
+	for _, used := range authentication.AuthenticationMethods {
+		if used == method {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAudience tells if the token is intended for the given audience, which may be one of several
+func (authentication *Authentication) HasAudience(audience string) bool {
+	for _, intended := range authentication.Audience {
+		if intended == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// Confirmation binds a token to a key or certificate of the client (RFC 7800). Bound tokens are only accepted
+// together with proof of possession of that key or certificate.
+type Confirmation struct {
+	// base64url encoded SHA-256 thumbprint of the client certificate (RFC 8705)
+	CertificateThumbprint string `json:"x5t#S256,omitempty"`
+	// JWK thumbprint of the key DPoP proofs have to be signed with (RFC 9449)
+	KeyThumbprint string `json:"jkt,omitempty"`
+	// hex encoded SHA-256 hash of the value of the fingerprint cookie; see Config.FingerprintCookieName
+	Fingerprint string `json:"fgp,omitempty"`
+}
+
+// IsServiceAccount tells if the authentication belongs to a machine caller, i.e. the client it has been issued to is
+// its subject, as in tokens of IssueServiceToken. Tokens a client obtained for a user carry the client ID as well,
+// with the user as subject.
+func (authentication *Authentication) IsServiceAccount() bool {
+	return authentication.ClientID != "" && authentication.Subject == authentication.ClientID
+}
+
+// Scopes lists the scopes granted to the token
+func (authentication *Authentication) Scopes() []string {
+	return strings.Fields(authentication.Scope)
+}
+
+// HasScope tells if the given scope has been granted to the token
+func (authentication *Authentication) HasScope(scope string) bool {
+	for _, granted := range authentication.Scopes() {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator resolves the Authentication of a request. Every Service is an Authenticator; NewMiddleware builds
+// the Middleware for any of them.
+type Authenticator interface {
+	// FromRequest returns the Authentication of the request. Errors should match the sentinel errors of this
+	// package, in particular ErrTokenMissing if the request carries no credentials at all.
+	FromRequest(r *http.Request) (*Authentication, error)
+}
+
+// Challenger is implemented by Authenticators which tell clients how to authenticate. The middleware sends the
+// challenge as WWW-Authenticate header with its 401 responses.
+type Challenger interface {
+	Challenge() string
 }
 
 // Service deals with all intricacies related to JWT tokens and translating them to an Authentication
 type Service interface {
-	FromRequest(r *http.Request) (*Authentication, error)
+	Authenticator
 
 	// FromCookie Transforms a Cookie into an Authentication object, returns error if not possible, expired or not valid
 	FromCookie(cookie *http.Cookie) (*Authentication, error)
@@ -68,4 +190,20 @@ type Middleware interface {
 	  of the given Roles assigned to him.
 	*/
 	HasAnyRole(roles ...string) func(next http.Handler) http.Handler
+
+	// RequireMFA checks that the user is in possession of a valid, non expired JWT Token obtained with a second factor.
+	RequireMFA(next http.Handler) http.Handler
+
+	/*
+	  RequireRecentAuth checks that the user is in possession of a valid, non expired JWT Token and has logged in
+	  at most maxAge ago, no matter how often the token has been refreshed since. Sensitive operations can use it
+	  to have the user log in again.
+	*/
+	RequireRecentAuth(maxAge time.Duration) func(next http.Handler) http.Handler
+
+	// IsServiceAccount checks that the caller is in possession of a valid, non expired service account token.
+	IsServiceAccount(next http.Handler) http.Handler
+
+	// IsUser checks that the caller is in possession of a valid, non expired JWT Token of a user.
+	IsUser(next http.Handler) http.Handler
 }
@@ -1,10 +1,15 @@
 package auth
 
 import (
+    "bytes"
+    "errors"
     "github.com/dgrijalva/jwt-go"
+    "log/slog"
     "net/http"
     "reflect"
+    "strings"
     "testing"
+    "time"
 )
 
 // issued at GMT Friday, 30. November 2018 10:00:40 (1543572040), valid until GMT: Friday, 30. November 2018 10:01:58 (1543572118)
@@ -128,12 +133,16 @@ func TestToAuthenticationWithExpiredAndTamperedToken(t *testing.T) {
         t.Fail()
     }
 
-    valError := err.(*jwt.ValidationError)
-    // should contain signature invalid error
-    if valError.Errors&jwt.ValidationErrorSignatureInvalid == 0 {
+    // should be reported as signature invalid error
+    if !errors.Is(err, ErrSignatureInvalid) {
         // if not, fail test
         t.Fail()
     }
+    // while the original validation error remains accessible
+    var valError *jwt.ValidationError
+    if !errors.As(err, &valError) || valError.Errors&jwt.ValidationErrorSignatureInvalid == 0 {
+        t.Fail()
+    }
 }
 
 /**
@@ -171,8 +180,12 @@ func TestToAuthentication(t *testing.T) {
         t.Errorf("Expected authentication is different than one retrieved from cookie")
     }
     // and error is token expired
-    if validationError, ok := validationError.(*jwt.ValidationError); ok {
-        if validationError.Errors != jwt.ValidationErrorExpired {
+    if !errors.Is(validationError, ErrTokenExpired) {
+        t.Errorf("Token should be expired")
+    }
+    var jwtValidationError *jwt.ValidationError
+    if errors.As(validationError, &jwtValidationError) {
+        if jwtValidationError.Errors != jwt.ValidationErrorExpired {
             t.Errorf("Token should only have error 'expired'")
         }
     } else {
@@ -256,3 +269,495 @@ func TestRefreshAuthenticationFailureForMaxTimeReached(t *testing.T) {
     }
 
 }
+
+/**
+  nbf, jti and aud should survive a round trip through the cookie.
+*/
+func TestRoundTripOfNotBeforeIDAndAudience(t *testing.T) {
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+    })
+
+    authentication := &Authentication{
+        ExpiresAt: expires2099,
+        IssuedAt:  issuedAt,
+        NotBefore: issuedAt,
+        ID:        "b0a4a5b6-2f5e-4bd4-8e1a-2c1f5d0c9c01",
+        Audience:  Audiences{"delorean"},
+        Issuer:    "flying dutchman",
+        Subject:   "superadmin",
+        Name:      "Marty McFly",
+    }
+
+    parsed, err := authService.FromCookie(authService.ToJWTCookie(authentication))
+
+    if err != nil {
+        t.Fatalf("Token should be valid, got %s", err)
+    }
+    if !reflect.DeepEqual(parsed, authentication) {
+        t.Errorf("Expected %+v, got %+v", authentication, parsed)
+    }
+}
+
+func TestAudienceList(t *testing.T) {
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+    })
+    sign := func(aud interface{}) string {
+        token := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.MapClaims{"sub": "marty", "exp": expires2099, "aud": aud})
+        signedString, _ := token.SignedString([]byte("privatesigningpassowrd"))
+        return signedString
+    }
+
+    authentication, err := authService.FromCookie(&http.Cookie{Value: sign([]string{"delorean"})})
+    if err != nil || !authentication.HasAudience("delorean") {
+        t.Errorf("Single audience list should be accepted, got %v (%v)", authentication, err)
+    }
+    authentication, err = authService.FromCookie(&http.Cookie{Value: sign([]string{"delorean", "hoverboard"})})
+    if err != nil || !authentication.HasAudience("delorean") || !authentication.HasAudience("hoverboard") || authentication.HasAudience("train") {
+        t.Errorf("Several audiences should be accepted, got %v (%v)", authentication, err)
+    }
+
+    // several audiences survive a round trip, a single one is signed as string again
+    reissued, _, _ := new(jwt.Parser).ParseUnverified(authService.ToJWTCookie(authentication).Value, jwt.MapClaims{})
+    if aud := reissued.Claims.(jwt.MapClaims)["aud"]; !reflect.DeepEqual(aud, []interface{}{"delorean", "hoverboard"}) {
+        t.Errorf("Audiences should be signed as list, got %v", aud)
+    }
+    authentication.Audience = Audiences{"delorean"}
+    reissued, _, _ = new(jwt.Parser).ParseUnverified(authService.ToJWTCookie(authentication).Value, jwt.MapClaims{})
+    if aud := reissued.Claims.(jwt.MapClaims)["aud"]; aud != "delorean" {
+        t.Errorf("Single audience should be signed as string, got %v", aud)
+    }
+    if _, err := authService.FromCookie(&http.Cookie{Value: sign(42)}); !errors.Is(err, ErrTokenMalformed) {
+        t.Errorf("Audience of another type should be rejected, got %v", err)
+    }
+}
+
+func TestToAuthenticationWithTokenNotValidYet(t *testing.T) {
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+    })
+
+    cookie := authService.ToJWTCookie(&Authentication{
+        ExpiresAt: expires2099,
+        IssuedAt:  issuedAt,
+        NotBefore: expires2099 - 60,
+        Subject:   "superadmin",
+    })
+
+    authentication, err := authService.FromCookie(cookie)
+
+    if authentication != nil {
+        t.Error("Token which is not yet active should not produce an authentication")
+    }
+    if !errors.Is(err, ErrTokenNotValidYet) {
+        t.Errorf("Should have returned a not valid yet error, got %v", err)
+    }
+}
+
+/**
+  Custom claims should round trip through the cookie, while reserved claim names can not be overridden.
+*/
+func TestRoundTripOfExtraClaims(t *testing.T) {
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+    })
+
+    authentication := &Authentication{
+        ExpiresAt: expires2099,
+        IssuedAt:  issuedAt,
+        Subject:   "superadmin",
+        Extra: map[string]interface{}{
+            "tenant":   "hill-valley",
+            "locale":   "en-US",
+            "features": []interface{}{"hoverboard", "flux-capacitor"},
+            "sub":      "biff",
+        },
+    }
+
+    parsed, err := authService.FromCookie(authService.ToJWTCookie(authentication))
+
+    if err != nil {
+        t.Fatalf("Token should be valid, got %s", err)
+    }
+    if parsed.Subject != "superadmin" {
+        t.Errorf("Reserved claim sub should not have been overridden by extra claims, got %s", parsed.Subject)
+    }
+    expectedExtra := map[string]interface{}{
+        "tenant":   "hill-valley",
+        "locale":   "en-US",
+        "features": []interface{}{"hoverboard", "flux-capacitor"},
+    }
+    if !reflect.DeepEqual(parsed.Extra, expectedExtra) {
+        t.Errorf("Expected extra claims %v, got %v", expectedExtra, parsed.Extra)
+    }
+}
+
+func TestExtraClaimsNamedLikeFieldsStayExtra(t *testing.T) {
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+        JWTCookieName: "JWT",
+    })
+    extra := map[string]interface{}{
+        "subject":      5.0,
+        "confirmation": map[string]interface{}{"fgp": "0000"},
+        "Username":     "biff",
+        "clientID":     "delorean",
+    }
+
+    cookie, err := authService.IssueCookie(&Authentication{Subject: "superadmin", ExpiresAt: expires2099, Extra: extra})
+    if err != nil {
+        t.Fatalf("Extra claims which are no reserved claims should be issued, got %s", err)
+    }
+    parsed, err := authService.FromCookie(cookie)
+
+    if err != nil {
+        t.Fatalf("Token should be valid, got %s", err)
+    }
+    if parsed.Subject != "superadmin" || parsed.Username != "" || parsed.ClientID != "" || parsed.Confirmation != nil {
+        t.Errorf("Extra claims should not end up in fields, got %+v", parsed)
+    }
+    if !reflect.DeepEqual(parsed.Extra, extra) {
+        t.Errorf("Expected extra claims %v, got %v", extra, parsed.Extra)
+    }
+}
+
+func TestIssueCookieFailsWithoutKey(t *testing.T) {
+    authService := New(Config{JWTCookieName: "JWT"})
+
+    cookie, err := authService.IssueCookie(&Authentication{Subject: "superadmin"})
+
+    if cookie != nil {
+        t.Error("No cookie should have been issued without a key")
+    }
+    if _, ok := err.(*ConfigError); !ok {
+        t.Errorf("Should have returned a config error, got %v", err)
+    }
+}
+
+func TestIssueCookieFailsForReservedExtraClaim(t *testing.T) {
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+        JWTCookieName: "JWT",
+    })
+
+    _, err := authService.IssueCookie(&Authentication{
+        Subject: "superadmin",
+        Extra:   map[string]interface{}{"exp": 1},
+    })
+
+    if err == nil {
+        t.Error("Should not be possible to override exp through extra claims")
+    }
+}
+
+func TestIssueCookieSignsLikeToJWTCookie(t *testing.T) {
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+        JWTCookieName: "JWT",
+    })
+
+    cookie, err := authService.IssueCookie(&Authentication{
+        ExpiresAt: expiresShortlyAfter,
+        Issuer:    "flying dutchman",
+        Subject:   "superadmin",
+        IssuedAt:  issuedAt,
+        Name:      "Marty McFly",
+        Authorities: []GrantedAuthority{
+            {
+                Role: "admin",
+                OrgUnits: []OrganizationalUnit{
+                    {Name: "org unit", Id: 21},
+                },
+            },
+        },
+    })
+
+    if err != nil {
+        t.Fatalf("Cookie should have been issued, got %s", err)
+    }
+    if cookie.Value != expiredToken || cookie.Name != "JWT" {
+        t.Errorf("Unexpected cookie %v", cookie)
+    }
+}
+
+func TestFromRequestWithoutCookie(t *testing.T) {
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+        JWTCookieName: "JWT",
+    })
+    req, _ := http.NewRequest("GET", "/", nil)
+
+    _, err := authService.FromRequest(req)
+
+    if !errors.Is(err, ErrTokenMissing) {
+        t.Errorf("Should have returned token missing error, got %v", err)
+    }
+}
+
+func TestIssueServiceToken(t *testing.T) {
+    authService := New(Config{
+        JWTPrivateKey:  []byte("privatesigningpassowrd"),
+        Issuer:         "AuthServer",
+        TokenExpiresIn: 300,
+    })
+
+    token, err := authService.IssueServiceToken("billing", []string{"invoices:read", "invoices:write"})
+    if err != nil {
+        t.Fatalf("Service token should have been issued, got %s", err)
+    }
+    authentication, err := authService.FromCookie(&http.Cookie{Value: token})
+    if err != nil {
+        t.Fatalf("Service token should be valid, got %s", err)
+    }
+
+    if authentication.ClientID != "billing" || authentication.Issuer != "AuthServer" {
+        t.Errorf("Unexpected service authentication %v", authentication)
+    }
+    if authentication.Subject != "billing" || authentication.Username != "" || authentication.AuthTime != 0 {
+        t.Errorf("Service token should not carry user fields, got %v", authentication)
+    }
+    if !authentication.IsServiceAccount() || !authentication.HasScope("invoices:write") || authentication.HasScope("invoices") {
+        t.Errorf("Unexpected scopes %v", authentication.Scopes())
+    }
+    if len(authentication.Extra) != 0 {
+        t.Errorf("client_id and scope should not end up in extra claims, got %v", authentication.Extra)
+    }
+}
+
+func TestIssueServiceTokenRequiresClientID(t *testing.T) {
+    authService := NewWithDefaults("privatesigningpassowrd")
+
+    if _, err := authService.IssueServiceToken("", nil); err == nil {
+        t.Error("Service token without client ID should not be issued")
+    }
+}
+
+func TestFromRequestWithBearerToken(t *testing.T) {
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+        JWTCookieName: "JWT",
+    })
+    req, _ := http.NewRequest("GET", "/", nil)
+    req.Header.Set("Authorization", "Bearer "+tokenValidUntil2099)
+
+    authentication, err := authService.FromRequest(req)
+
+    if err != nil || authentication.Subject == "" {
+        t.Errorf("Bearer token should have been accepted, got %v (%v)", authentication, err)
+    }
+}
+
+func TestFingerprintBoundCookies(t *testing.T) {
+    authService := New(Config{
+        JWTPrivateKey:         []byte("privatesigningpassowrd"),
+        JWTCookieName:         "JWT",
+        FingerprintCookieName: "__Secure-Fgp",
+    })
+    cookies, err := authService.IssueCookies(&Authentication{Subject: "marty", ExpiresAt: expires2099})
+    if err != nil || len(cookies) != 2 {
+        t.Fatalf("JWT and fingerprint cookie should have been issued, got %v (%v)", cookies, err)
+    }
+    jwtCookie, fingerprintCookie := cookies[0], cookies[1]
+    if !fingerprintCookie.HttpOnly || !fingerprintCookie.Secure || fingerprintCookie.SameSite != http.SameSiteStrictMode {
+        t.Errorf("Fingerprint cookie should be hardened, got %v", fingerprintCookie)
+    }
+    if strings.Contains(jwtCookie.Value, fingerprintCookie.Value) {
+        t.Error("Token should only carry the hash of the fingerprint")
+    }
+
+    cases := map[string]struct {
+        fingerprint   string
+        expectedError error
+    }{
+        "matching fingerprint": {fingerprint: fingerprintCookie.Value},
+        "other fingerprint":    {fingerprint: "0123456789abcdef", expectedError: ErrBindingMismatch},
+        "no fingerprint":       {expectedError: ErrBindingMismatch},
+    }
+
+    for name, c := range cases {
+        req, _ := http.NewRequest("GET", "/", nil)
+        req.AddCookie(jwtCookie)
+        if c.fingerprint != "" {
+            req.AddCookie(&http.Cookie{Name: "__Secure-Fgp", Value: c.fingerprint})
+        }
+
+        authentication, err := authService.FromRequest(req)
+
+        if c.expectedError != nil && !errors.Is(err, c.expectedError) {
+            t.Errorf("%s: expected %v, got %v", name, c.expectedError, err)
+        }
+        if c.expectedError == nil && (err != nil || authentication.Subject != "marty") {
+            t.Errorf("%s: unexpected authentication %v (%v)", name, authentication, err)
+        }
+    }
+}
+
+func TestFingerprintCookieRequiresBoundTokens(t *testing.T) {
+    config := Config{
+        JWTPrivateKey:  []byte("privatesigningpassowrd"),
+        JWTCookieName:  "JWT",
+        MaxRenewalTime: 3600,
+    }
+    unbound := New(config).ToJWTCookie(&Authentication{Subject: "marty", ExpiresAt: expires2099})
+    config.FingerprintCookieName = "__Secure-Fgp"
+    var logs bytes.Buffer
+    config.Logger = slog.New(slog.NewJSONHandler(&logs, nil))
+    authService := New(config)
+
+    req, _ := http.NewRequest("GET", "/", nil)
+    req.AddCookie(unbound)
+    req.AddCookie(&http.Cookie{Name: "__Secure-Fgp", Value: "0123456789abcdef"})
+    if _, err := authService.FromRequest(req); !errors.Is(err, ErrBindingMismatch) {
+        t.Errorf("Token without fingerprint should be rejected, got %v", err)
+    }
+
+    if _, err := authService.IssueCookie(&Authentication{Subject: "marty", ExpiresAt: expires2099}); !errors.Is(err, ErrBindingMismatch) {
+        t.Errorf("IssueCookie should refuse to issue a token without fingerprint, got %v", err)
+    }
+    // a client acting for a user is no service account
+    if _, err := authService.IssueCookie(&Authentication{Subject: "marty", ClientID: "billing", ExpiresAt: expires2099}); !errors.Is(err, ErrBindingMismatch) {
+        t.Errorf("IssueCookie should refuse to issue a user token of a client without fingerprint, got %v", err)
+    }
+    if cookie := authService.ToJWTCookie(&Authentication{Subject: "marty", ExpiresAt: expires2099}); cookie.Value != "" {
+        t.Errorf("ToJWTCookie should not issue a token without fingerprint, got %s", cookie.Value)
+    }
+    if !strings.Contains(logs.String(), `"level":"WARN","msg":"Unable to issue token cookie`) {
+        t.Errorf("Refusing to issue a token should be logged at warn level, got %s", logs.String())
+    }
+
+    // refreshed authentications keep their fingerprint
+    cookies, _ := authService.IssueCookies(&Authentication{Subject: "marty", IssuedAt: time.Now().Unix(), ExpiresAt: expires2099})
+    req, _ = http.NewRequest("GET", "/", nil)
+    for _, cookie := range cookies {
+        req.AddCookie(cookie)
+    }
+    authentication, _ := authService.FromRequest(req)
+    refreshed, _ := authService.RefreshAuthentication(authentication)
+    if _, err := authService.IssueCookie(refreshed); err != nil {
+        t.Errorf("Refreshed token should keep its fingerprint, got %v", err)
+    }
+
+    // service tokens are sent as bearer tokens by machine callers
+    token, _ := authService.IssueServiceToken("billing", nil)
+    req, _ = http.NewRequest("GET", "/", nil)
+    req.Header.Set("Authorization", "Bearer "+token)
+    if _, err := authService.FromRequest(req); err != nil {
+        t.Errorf("Service token should be accepted without fingerprint, got %v", err)
+    }
+}
+
+func TestFromCookieRejectsBoundTokens(t *testing.T) {
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+        JWTCookieName: "JWT",
+    })
+
+    confirmations := map[string]Confirmation{
+        "certificate": {CertificateThumbprint: "x5t"},
+        "DPoP key":    {KeyThumbprint: "jkt"},
+        "fingerprint": {Fingerprint: hashFingerprint("fgp")},
+    }
+
+    for name, confirmation := range confirmations {
+        confirmation := confirmation
+        cookie := authService.ToJWTCookie(&Authentication{Subject: "marty", ExpiresAt: expires2099, Confirmation: &confirmation})
+
+        authentication, err := authService.FromCookie(cookie)
+
+        if authentication != nil || !errors.Is(err, ErrBindingMismatch) {
+            t.Errorf("%s: bound token should be rejected without request, got %v (%v)", name, authentication, err)
+        }
+    }
+}
+
+func TestIssueCookiesWithoutFingerprint(t *testing.T) {
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+        JWTCookieName: "JWT",
+    })
+
+    cookies, err := authService.IssueCookies(&Authentication{ExpiresAt: expires2099})
+
+    if err != nil || len(cookies) != 1 || cookies[0].Name != "JWT" {
+        t.Errorf("Only the JWT cookie should have been issued, got %v (%v)", cookies, err)
+    }
+}
+
+func TestFromCookieWithMalformedToken(t *testing.T) {
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+    })
+
+    authentication, err := authService.FromCookie(&http.Cookie{Value: "not a token"})
+
+    if authentication != nil || !errors.Is(err, ErrTokenMalformed) {
+        t.Errorf("Should have returned token malformed error, got %v", err)
+    }
+}
+
+func TestFromCookieWithIssuerMismatch(t *testing.T) {
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+        Issuer:        "AuthServer",
+        VerifyIssuer:  true,
+    })
+
+    authentication, err := authService.FromCookie(&http.Cookie{Value: tokenValidUntil2099})
+
+    if authentication != nil || !errors.Is(err, ErrIssuerMismatch) {
+        t.Errorf("Should have returned issuer mismatch error, got %v", err)
+    }
+}
+
+/**
+  Tokens of a default config without issuer are stamped with the configured one, so that they still verify once the
+  issuer is checked.
+*/
+func TestRoundTripWithDefaultConfig(t *testing.T) {
+    for _, verifyIssuer := range []bool{false, true} {
+        config := DefaultAuthConfig([]byte("privatesigningpassowrd"))
+        config.VerifyIssuer = verifyIssuer
+        authService := New(config)
+
+        authentication, err := authService.FromCookie(authService.ToJWTCookie(&Authentication{Subject: "marty", ExpiresAt: expires2099}))
+
+        if err != nil || authentication.Issuer != "AuthServer" {
+            t.Errorf("Token should be valid and issued by the config issuer, got %v (%v)", authentication, err)
+        }
+    }
+}
+
+type revokedSubjects []string
+
+func (subjects revokedSubjects) IsRevoked(authentication *Authentication) (bool, error) {
+    for _, subject := range subjects {
+        if subject == authentication.Subject {
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+func TestFromCookieWithRevokedToken(t *testing.T) {
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+        Revocations:   revokedSubjects{"superadmin"},
+    })
+
+    authentication, err := authService.FromCookie(&http.Cookie{Value: tokenValidUntil2099})
+
+    if authentication != nil || !errors.Is(err, ErrRevoked) {
+        t.Errorf("Should have returned revoked error, got %v", err)
+    }
+}
+
+func TestRefreshErrorMatchesRefreshWindowExceeded(t *testing.T) {
+    authService := New(Config{MaxRenewalTime: 5})
+
+    _, err := authService.RefreshAuthentication(&Authentication{IssuedAt: issuedAt})
+
+    if !errors.Is(err, ErrRefreshWindowExceeded) || errors.Is(err, ErrTokenExpired) {
+        t.Errorf("Should have returned refresh window exceeded error, got %v", err)
+    }
+}
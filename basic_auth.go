@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// BasicAuthenticator authenticates legacy tooling and health scrapers through HTTP Basic auth. Credentials are
+// checked by a CredentialVerifier on every request, so a verifier with an expensive password hash makes every such
+// request expensive as well.
+type BasicAuthenticator struct {
+	Middleware
+
+	verifier CredentialVerifier
+	// realm sent in the WWW-Authenticate header, "Restricted" if empty
+	Realm string
+	// optional protection against brute force attacks, like the one of the LoginHandler. Throttled requests are
+	// answered with 429 Too Many Requests and a Retry-After header by the middleware. As every request is an
+	// attempt, clients sending more than FreeAttempts requests at once may get throttled as well.
+	Limiter *LoginLimiter
+	// logger of failures of the Limiter and, through the middleware, of internal errors. Defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// NewBasicAuthenticator creates a BasicAuthenticator challenging clients for the given realm
+func NewBasicAuthenticator(verifier CredentialVerifier, realm string) *BasicAuthenticator {
+	authenticator := &BasicAuthenticator{
+		verifier: verifier,
+		Realm:    realm,
+	}
+	authenticator.Middleware = NewMiddleware(authenticator)
+	return authenticator
+}
+
+// FromRequest verifies the Basic auth credentials of the request. Missing credentials match ErrTokenMissing, wrong
+// ones ErrInvalidCredentials, and throttled attempts ErrTooManyAttempts. Credentials which could not be verified at
+// all match ErrInternal, so that the middleware neither answers them with 401 nor shows the error to the client.
+func (authenticator *BasicAuthenticator) FromRequest(r *http.Request) (*Authentication, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, &Error{ErrorCode: TokenMissing, Cause: errors.New("no basic auth credentials")}
+	}
+
+	limiter := authenticator.Limiter
+	var userKey, ipKey string
+	if limiter != nil {
+		userKey, ipKey = limiter.keys(r, username)
+		wait, err := limiter.Reserve(r.Context(), userKey, ipKey)
+		if err != nil {
+			return nil, &Error{ErrorCode: InternalError, Cause: fmt.Errorf("unable to check login attempts: %w", err)}
+		}
+		if wait > 0 {
+			return nil, &Error{ErrorCode: TooManyAttempts, Cause: retryAfter(wait)}
+		}
+	}
+
+	authentication, err := authenticator.verifier.VerifyCredentials(r.Context(), username, password)
+	if err == nil && authentication == nil {
+		err = ErrInvalidCredentials
+	}
+	if err != nil {
+		if errors.Is(err, ErrInvalidCredentials) {
+			// the reserved attempt remains as failure
+			return nil, ErrInvalidCredentials
+		}
+		if limiter != nil {
+			authenticator.release(r, userKey, ipKey)
+		}
+		return nil, &Error{ErrorCode: InternalError, Cause: fmt.Errorf("unable to verify credentials: %w", err)}
+	}
+	if limiter != nil {
+		if err := limiter.Success(r.Context(), userKey); err != nil {
+			authenticator.logger().ErrorContext(r.Context(), "Unable to reset login attempts", "error", err)
+		}
+		authenticator.release(r, ipKey)
+	}
+	authentication.AuthenticationMethods = []string{AMRPassword}
+	authentication.AuthenticationContextClass = ACRSingleFactor
+	return authentication, nil
+}
+
+// Challenge asks for Basic auth credentials of the realm
+func (authenticator *BasicAuthenticator) Challenge() string {
+	realm := authenticator.Realm
+	if realm == "" {
+		realm = "Restricted"
+	}
+	return "Basic realm=" + strconv.Quote(realm) + `, charset="UTF-8"`
+}
+
+// --------------------------
+// private stuff
+// --------------------------
+
+// logger is the configured Logger, or slog.Default()
+func (authenticator *BasicAuthenticator) logger() *slog.Logger {
+	if authenticator.Logger != nil {
+		return authenticator.Logger
+	}
+	return slog.Default()
+}
+
+// release gives back attempts reserved with the Limiter
+func (authenticator *BasicAuthenticator) release(r *http.Request, keys ...string) {
+	if err := authenticator.Limiter.Release(r.Context(), keys...); err != nil {
+		authenticator.logger().ErrorContext(r.Context(), "Unable to release login attempt", "error", err)
+	}
+}
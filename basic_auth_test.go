@@ -0,0 +1,193 @@
+package auth
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestBasicAuthentication(t *testing.T) {
+    authenticator := NewBasicAuthenticator(staticVerifier{"prometheus": "scrape"}, "metrics")
+
+    cases := map[string]struct {
+        username      string
+        password      string
+        expectedError error
+    }{
+        "valid credentials": {username: "prometheus", password: "scrape"},
+        "wrong password":    {username: "prometheus", password: "guess", expectedError: ErrInvalidCredentials},
+        "no credentials":    {expectedError: ErrTokenMissing},
+    }
+
+    for name, c := range cases {
+        req, _ := newRequestResponseEmulation(t)
+        if c.username != "" {
+            req.SetBasicAuth(c.username, c.password)
+        }
+
+        authentication, err := authenticator.FromRequest(req)
+
+        if c.expectedError != nil && !errors.Is(err, c.expectedError) {
+            t.Errorf("%s: expected %v, got %v", name, c.expectedError, err)
+        }
+        if c.expectedError == nil && (err != nil || !authentication.HasAuthenticationMethod(AMRPassword)) {
+            t.Errorf("%s: unexpected authentication %v (%v)", name, authentication, err)
+        }
+    }
+}
+
+func TestBasicAuthMiddlewareChallengesWithRealm(t *testing.T) {
+    authenticator := NewBasicAuthenticator(staticVerifier{"prometheus": "scrape"}, "metrics")
+    nextHandler := &nextHandler{}
+    req, rr := newRequestResponseEmulation(t)
+
+    authenticator.IsAuthenticated(nextHandler).ServeHTTP(rr, req)
+
+    if nextHandler.Visited || rr.Code != http.StatusUnauthorized {
+        t.Fatalf("Request without credentials should be unauthorized, got %d", rr.Code)
+    }
+    if challenge := rr.Header().Get("WWW-Authenticate"); challenge != `Basic realm="metrics", charset="UTF-8"` {
+        t.Errorf("Unexpected challenge %s", challenge)
+    }
+}
+
+func TestChainOfCookieAndBasicAuth(t *testing.T) {
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+        JWTCookieName: "JWT",
+    })
+    middleware := NewMiddleware(Chain(authService, NewBasicAuthenticator(staticVerifier{"prometheus": "scrape"}, "metrics")))
+
+    cases := map[string]struct {
+        cookie        string
+        basicAuth     bool
+        expectedVisit bool
+    }{
+        "JWT cookie": {cookie: tokenValidUntil2099, expectedVisit: true},
+        "basic auth": {basicAuth: true, expectedVisit: true},
+        "nothing":    {expectedVisit: false},
+    }
+
+    for name, c := range cases {
+        nextHandler := &nextHandler{}
+        req, rr := newRequestResponseEmulation(t)
+        if c.cookie != "" {
+            req.AddCookie(&http.Cookie{Name: "JWT", Value: c.cookie})
+        }
+        if c.basicAuth {
+            req.SetBasicAuth("prometheus", "scrape")
+        }
+
+        middleware.IsAuthenticated(nextHandler).ServeHTTP(rr, req)
+
+        if nextHandler.Visited != c.expectedVisit {
+            t.Errorf("%s: expected next handler visited to be %v", name, c.expectedVisit)
+        }
+        if !c.expectedVisit && rr.Header().Get("WWW-Authenticate") == "" {
+            t.Errorf("%s: chained basic auth should challenge the client", name)
+        }
+    }
+}
+
+// namingVerifier rejects everybody with an error naming the user
+type namingVerifier struct{}
+
+func (namingVerifier) VerifyCredentials(ctx context.Context, username, password string) (*Authentication, error) {
+    return nil, fmt.Errorf("wrong password of %s: %w", username, ErrInvalidCredentials)
+}
+
+func TestBasicAuthDoesNotShowUsernamesOfVerifierErrors(t *testing.T) {
+    users := NewInMemoryUsers(DefaultArgon2idHasher())
+    users.AddHashed("marty", "$argon2id$broken", Authentication{Username: "marty"})
+
+    cases := map[string]struct {
+        verifier     CredentialVerifier
+        expectedCode int
+    }{
+        "invalid credentials": {verifier: namingVerifier{}, expectedCode: http.StatusUnauthorized},
+        "broken hash":         {verifier: users, expectedCode: http.StatusInternalServerError},
+    }
+
+    for name, c := range cases {
+        var logs bytes.Buffer
+        authService := New(DefaultAuthConfig([]byte("privatesigningpassowrd")))
+        authService.authConfig.Logger = slog.New(slog.NewJSONHandler(&logs, nil))
+        authenticator := NewBasicAuthenticator(c.verifier, "metrics")
+        req, rr := newRequestResponseEmulation(t)
+        req.SetBasicAuth("marty", "delorean")
+
+        NewMiddleware(Chain(authService, authenticator)).IsAuthenticated(&nextHandler{}).ServeHTTP(rr, req)
+
+        if rr.Code != c.expectedCode {
+            t.Errorf("%s: expected %d, got %d", name, c.expectedCode, rr.Code)
+        }
+        if strings.Contains(rr.Body.String(), "marty") || strings.Contains(logs.String(), "marty") {
+            t.Errorf("%s: username should neither be shown nor logged, got %s (%s)", name, rr.Body.String(), logs.String())
+        }
+    }
+}
+
+// forgetfulStore is unable to forget attempts
+type forgetfulStore struct {
+    RateLimitStore
+}
+
+func (forgetfulStore) Delete(ctx context.Context, key string) error {
+    return errors.New("store unavailable")
+}
+
+func TestBasicAuthLogsToItsLogger(t *testing.T) {
+    var logs bytes.Buffer
+    authenticator := NewBasicAuthenticator(staticVerifier{"marty": "delorean"}, "metrics")
+    authenticator.Limiter = NewLoginLimiter(forgetfulStore{NewInMemoryRateLimitStore()})
+    authenticator.Logger = slog.New(slog.NewJSONHandler(&logs, nil))
+    req, rr := newRequestResponseEmulation(t)
+    req.SetBasicAuth("marty", "delorean")
+
+    authenticator.IsAuthenticated(&nextHandler{}).ServeHTTP(rr, req)
+
+    if rr.Code != http.StatusOK {
+        t.Errorf("Request should pass although attempts cannot be reset, got %d", rr.Code)
+    }
+    if !strings.Contains(logs.String(), "store unavailable") {
+        t.Errorf("Failure of the store should be logged to the Logger, got %s", logs.String())
+    }
+}
+
+func TestBasicAuthIsThrottledByLimiter(t *testing.T) {
+    authenticator := NewBasicAuthenticator(staticVerifier{"prometheus": "scrape"}, "metrics")
+    authenticator.Limiter = NewLoginLimiter(NewInMemoryRateLimitStore())
+    now := time.Unix(1_700_000_000, 0)
+    authenticator.Limiter.now = func() time.Time { return now }
+
+    request := func(password string) (*nextHandler, *httptest.ResponseRecorder) {
+        nextHandler := &nextHandler{}
+        req, rr := newRequestResponseEmulation(t)
+        req.SetBasicAuth("prometheus", password)
+        authenticator.IsAuthenticated(nextHandler).ServeHTTP(rr, req)
+        return nextHandler, rr
+    }
+
+    for i := 0; i < authenticator.Limiter.FreeAttempts+1; i++ {
+        if _, rr := request("guess"); rr.Code != http.StatusUnauthorized {
+            t.Fatalf("Attempt %d should be unauthorized, got %d", i+1, rr.Code)
+        }
+    }
+
+    nextHandler, rr := request("scrape")
+    if nextHandler.Visited || rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "1" {
+        t.Fatalf("Expected 429 with Retry-After 1, got %d (%q)", rr.Code, rr.Header().Get("Retry-After"))
+    }
+
+    now = now.Add(time.Second)
+    if nextHandler, rr := request("scrape"); !nextHandler.Visited {
+        t.Errorf("Right credentials should pass once the delay is over, got %d", rr.Code)
+    }
+}
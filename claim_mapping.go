@@ -0,0 +1,332 @@
+package auth
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ClaimMapping turns claims of tokens issued by other systems (Keycloak, Auth0, Azure AD...) into Authorities.
+//
+// Claims are addressed by paths of dot separated names, e.g. "realm_access.roles". Names containing dots are
+// quoted in brackets, e.g. `["https://example.com/roles"]`, and "*" stands for all entries of an object or
+// array, e.g. "resource_access.*.roles". Arrays met along the way are flattened.
+type ClaimMapping struct {
+	// rules producing authorities. All rules are applied; authorities with the same role are merged.
+	Roles []RoleRule `json:"roles,omitempty"`
+	// org units attached to every mapped authority
+	OrgUnits []OrgUnitRule `json:"orgUnits,omitempty"`
+}
+
+// RoleRule reads roles from a claim. The claim may hold a single role or a list of roles, either as plain strings or
+// as objects.
+type RoleRule struct {
+	Path string `json:"path"`
+	// path of the role within each object found at Path; empty if roles are plain strings
+	Role string `json:"role,omitempty"`
+	// stripped from the start of each role, e.g. "/" for group paths
+	TrimPrefix string `json:"trimPrefix,omitempty"`
+	// renames roles after trimming; roles not listed are kept as they are
+	Rename map[string]string `json:"rename,omitempty"`
+	// added to the start of each role after renaming, e.g. "ROLE_"
+	Prefix string `json:"prefix,omitempty"`
+	// org units of each role, relative to each object found at Path
+	OrgUnits []OrgUnitRule `json:"orgUnits,omitempty"`
+}
+
+// OrgUnitRule reads org units from a claim. Plain strings are taken as name and plain numbers as id of the org unit.
+type OrgUnitRule struct {
+	Path string `json:"path"`
+	// path of the id within each object found at Path
+	ID string `json:"id,omitempty"`
+	// path of the name within each object found at Path
+	Name string `json:"name,omitempty"`
+}
+
+// Apply maps the claims to authorities
+func (mapping ClaimMapping) Apply(claims map[string]interface{}) ([]GrantedAuthority, error) {
+	commonOrgUnits, err := applyOrgUnitRules(mapping.OrgUnits, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	var authorities []GrantedAuthority
+	index := map[string]int{}
+	for _, rule := range mapping.Roles {
+		values, err := lookupClaim(claims, rule.Path)
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range values {
+			role, orgUnits, err := rule.apply(value)
+			if err != nil {
+				return nil, err
+			}
+			if role == "" {
+				continue
+			}
+			orgUnits = append(orgUnits, commonOrgUnits...)
+
+			if i, found := index[role]; found {
+				authorities[i].OrgUnits = appendOrgUnits(authorities[i].OrgUnits, orgUnits...)
+				continue
+			}
+			index[role] = len(authorities)
+			authorities = append(authorities, GrantedAuthority{Role: role, OrgUnits: appendOrgUnits(nil, orgUnits...)})
+		}
+	}
+	return authorities, nil
+}
+
+// Validate checks the syntax of all paths
+func (mapping ClaimMapping) Validate() error {
+	var problems []string
+	check := func(path string) {
+		if _, err := parseClaimPath(path); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	checkOrgUnits := func(rules []OrgUnitRule) {
+		for _, rule := range rules {
+			check(rule.Path)
+			for _, relative := range []string{rule.ID, rule.Name} {
+				if relative != "" {
+					check(relative)
+				}
+			}
+		}
+	}
+
+	for _, rule := range mapping.Roles {
+		check(rule.Path)
+		if rule.Role != "" {
+			check(rule.Role)
+		}
+		checkOrgUnits(rule.OrgUnits)
+	}
+	checkOrgUnits(mapping.OrgUnits)
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// OIDCClaimMapper maps ID token claims with DefaultOIDCClaimMapper, taking the authorities from this mapping
+func (mapping ClaimMapping) OIDCClaimMapper() func(claims map[string]interface{}) (*Authentication, error) {
+	return func(claims map[string]interface{}) (*Authentication, error) {
+		authentication, err := DefaultOIDCClaimMapper(claims)
+		if err != nil {
+			return nil, err
+		}
+		authentication.Authorities, err = mapping.Apply(claims)
+		if err != nil {
+			return nil, err
+		}
+		return authentication, nil
+	}
+}
+
+// --------------------------
+// private stuff
+// --------------------------
+
+// apply extracts role and org units from one value found at the path of the rule
+func (rule RoleRule) apply(value interface{}) (string, []OrganizationalUnit, error) {
+	roleValue := value
+	if rule.Role != "" {
+		values, err := lookupClaim(value, rule.Role)
+		if err != nil || len(values) == 0 {
+			return "", nil, err
+		}
+		roleValue = values[0]
+	}
+	role, ok := roleValue.(string)
+	if !ok {
+		return "", nil, nil
+	}
+
+	role = strings.TrimPrefix(role, rule.TrimPrefix)
+	if renamed, found := rule.Rename[role]; found {
+		role = renamed
+	}
+	if role == "" {
+		return "", nil, nil
+	}
+
+	orgUnits, err := applyOrgUnitRules(rule.OrgUnits, value)
+	return rule.Prefix + role, orgUnits, err
+}
+
+func applyOrgUnitRules(rules []OrgUnitRule, claims interface{}) ([]OrganizationalUnit, error) {
+	var orgUnits []OrganizationalUnit
+	for _, rule := range rules {
+		values, err := lookupClaim(claims, rule.Path)
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range values {
+			orgUnit, err := rule.apply(value)
+			if err != nil {
+				return nil, err
+			}
+			if orgUnit != (OrganizationalUnit{}) {
+				orgUnits = appendOrgUnits(orgUnits, orgUnit)
+			}
+		}
+	}
+	return orgUnits, nil
+}
+
+func (rule OrgUnitRule) apply(value interface{}) (OrganizationalUnit, error) {
+	switch typed := value.(type) {
+	case string:
+		return OrganizationalUnit{Name: typed}, nil
+	case float64:
+		return OrganizationalUnit{Id: int64(typed)}, nil
+	}
+
+	var orgUnit OrganizationalUnit
+	if rule.ID != "" {
+		ids, err := lookupClaim(value, rule.ID)
+		if err != nil {
+			return orgUnit, err
+		}
+		if len(ids) > 0 {
+			orgUnit.Id = int64(toFloat64(ids[0]))
+		}
+	}
+	if rule.Name != "" {
+		names, err := lookupClaim(value, rule.Name)
+		if err != nil {
+			return orgUnit, err
+		}
+		if len(names) > 0 {
+			orgUnit.Name = toString(names[0])
+		}
+	}
+	return orgUnit, nil
+}
+
+// appendOrgUnits appends org units which are not contained yet
+func appendOrgUnits(orgUnits []OrganizationalUnit, additional ...OrganizationalUnit) []OrganizationalUnit {
+	for _, orgUnit := range additional {
+		contained := false
+		for _, existing := range orgUnits {
+			if existing == orgUnit {
+				contained = true
+				break
+			}
+		}
+		if !contained {
+			orgUnits = append(orgUnits, orgUnit)
+		}
+	}
+	return orgUnits
+}
+
+// lookupClaim collects all values found at a path. Missing claims yield no values.
+func lookupClaim(claims interface{}, path string) ([]interface{}, error) {
+	segments, err := parseClaimPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	current := []interface{}{claims}
+	for _, segment := range segments {
+		var next []interface{}
+		for _, value := range current {
+			next = append(next, descend(value, segment)...)
+		}
+		current = next
+	}
+
+	// flatten arrays found at the end of the path
+	var values []interface{}
+	for _, value := range current {
+		if array, ok := value.([]interface{}); ok {
+			values = append(values, array...)
+		} else if value != nil {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// descend resolves one path segment. Arrays are looked through, so that "groups.name" works on a list of objects.
+func descend(value interface{}, segment claimPathSegment) []interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		if segment.wildcard {
+			// sorted by name, so that the resulting authorities have a stable order
+			names := make([]string, 0, len(typed))
+			for name := range typed {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			values := make([]interface{}, 0, len(typed))
+			for _, name := range names {
+				values = append(values, typed[name])
+			}
+			return values
+		}
+		if child, found := typed[segment.name]; found {
+			return []interface{}{child}
+		}
+	case []interface{}:
+		if segment.wildcard {
+			return typed
+		}
+		var values []interface{}
+		for _, element := range typed {
+			values = append(values, descend(element, segment)...)
+		}
+		return values
+	}
+	return nil
+}
+
+type claimPathSegment struct {
+	name     string
+	wildcard bool
+}
+
+// parseClaimPath splits a path like `resource_access.*.roles` or `["https://example.com/roles"]` into segments
+func parseClaimPath(path string) ([]claimPathSegment, error) {
+	if path == "" {
+		return nil, fmt.Errorf("claim path must not be empty")
+	}
+
+	var segments []claimPathSegment
+	for rest := path; rest != ""; {
+		if strings.HasPrefix(rest, `["`) {
+			end := strings.Index(rest, `"]`)
+			if end < 0 {
+				return nil, fmt.Errorf("claim path %q: unterminated quoted name", path)
+			}
+			segments = append(segments, claimPathSegment{name: rest[2:end]})
+			rest = rest[end+2:]
+		} else {
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			if name == "" {
+				return nil, fmt.Errorf("claim path %q: empty name", path)
+			}
+			segments = append(segments, claimPathSegment{name: name, wildcard: name == "*"})
+			rest = rest[end:]
+		}
+
+		if strings.HasPrefix(rest, ".") {
+			rest = rest[1:]
+			if rest == "" {
+				return nil, fmt.Errorf("claim path %q: trailing dot", path)
+			}
+		} else if rest != "" && !strings.HasPrefix(rest, "[") {
+			return nil, fmt.Errorf("claim path %q: unexpected %q", path, rest)
+		}
+	}
+	return segments, nil
+}
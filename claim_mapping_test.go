@@ -0,0 +1,148 @@
+package auth
+
+import (
+    "encoding/json"
+    "reflect"
+    "testing"
+)
+
+const upstreamClaims = `{
+    "sub": "marty",
+    "realm_access": {"roles": ["offline_access", "admin"]},
+    "resource_access": {
+        "delorean": {"roles": ["driver"]},
+        "hoverboard": {"roles": ["rider", "admin"]}
+    },
+    "groups": ["/hill-valley/admins"],
+    "https://example.com/roles": "editor",
+    "memberships": [
+        {"role": "manager", "unit": {"id": 21, "name": "org unit"}},
+        {"role": "member", "unit": {"id": 42, "name": "other unit"}}
+    ],
+    "tenants": ["hill-valley"]
+}`
+
+func decodeClaims(t *testing.T, encoded string) map[string]interface{} {
+    var claims map[string]interface{}
+    if err := json.Unmarshal([]byte(encoded), &claims); err != nil {
+        t.Fatal(err)
+    }
+    return claims
+}
+
+func roles(authorities []GrantedAuthority) []string {
+    var roles []string
+    for _, authority := range authorities {
+        roles = append(roles, authority.Role)
+    }
+    return roles
+}
+
+func TestClaimMappingOfUpstreamRoles(t *testing.T) {
+    cases := map[string]struct {
+        rule     RoleRule
+        expected []string
+    }{
+        "keycloak realm roles": {
+            rule:     RoleRule{Path: "realm_access.roles", Rename: map[string]string{"admin": "ADMIN"}},
+            expected: []string{"offline_access", "ADMIN"},
+        },
+        "keycloak client roles": {
+            rule:     RoleRule{Path: "resource_access.delorean.roles", Prefix: "ROLE_"},
+            expected: []string{"ROLE_driver"},
+        },
+        "azure groups": {
+            rule:     RoleRule{Path: "groups", TrimPrefix: "/hill-valley/"},
+            expected: []string{"admins"},
+        },
+        "auth0 namespaced claim": {
+            rule:     RoleRule{Path: `["https://example.com/roles"]`},
+            expected: []string{"editor"},
+        },
+        "objects": {
+            rule:     RoleRule{Path: "memberships", Role: "role"},
+            expected: []string{"manager", "member"},
+        },
+        "missing claim": {
+            rule:     RoleRule{Path: "roles"},
+            expected: nil,
+        },
+    }
+
+    claims := decodeClaims(t, upstreamClaims)
+    for name, c := range cases {
+        authorities, err := ClaimMapping{Roles: []RoleRule{c.rule}}.Apply(claims)
+        if err != nil {
+            t.Errorf("%s: %s", name, err)
+        }
+        if !reflect.DeepEqual(roles(authorities), c.expected) {
+            t.Errorf("%s: expected %v, got %v", name, c.expected, roles(authorities))
+        }
+    }
+}
+
+func TestClaimMappingWithWildcardMergesRoles(t *testing.T) {
+    mapping := ClaimMapping{Roles: []RoleRule{{Path: "resource_access.*.roles"}, {Path: "realm_access.roles"}}}
+
+    authorities, _ := mapping.Apply(decodeClaims(t, upstreamClaims))
+
+    count := map[string]int{}
+    for _, role := range roles(authorities) {
+        count[role]++
+    }
+    if len(count) != 4 || count["admin"] != 1 {
+        t.Errorf("Expected 4 distinct roles, got %v", roles(authorities))
+    }
+}
+
+func TestClaimMappingOfOrgUnits(t *testing.T) {
+    mapping := ClaimMapping{
+        Roles: []RoleRule{{
+            Path:     "memberships",
+            Role:     "role",
+            OrgUnits: []OrgUnitRule{{Path: "unit", ID: "id", Name: "name"}},
+        }},
+        OrgUnits: []OrgUnitRule{{Path: "tenants"}},
+    }
+
+    authorities, err := mapping.Apply(decodeClaims(t, upstreamClaims))
+
+    expected := []GrantedAuthority{
+        {Role: "manager", OrgUnits: []OrganizationalUnit{{Id: 21, Name: "org unit"}, {Name: "hill-valley"}}},
+        {Role: "member", OrgUnits: []OrganizationalUnit{{Id: 42, Name: "other unit"}, {Name: "hill-valley"}}},
+    }
+    if err != nil || !reflect.DeepEqual(authorities, expected) {
+        t.Errorf("Expected %+v, got %+v (%v)", expected, authorities, err)
+    }
+}
+
+func TestClaimMappingValidation(t *testing.T) {
+    mapping := ClaimMapping{Roles: []RoleRule{{Path: "realm_access."}, {Path: `["unterminated`}, {Path: "a..b"}}}
+
+    err := mapping.Validate()
+
+    if configError, ok := err.(*ConfigError); !ok || len(configError.Problems) != 3 {
+        t.Errorf("Expected 3 problems, got %v", err)
+    }
+}
+
+func TestFromCookieAppliesClaimMapping(t *testing.T) {
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+        ClaimMapping:  &ClaimMapping{Roles: []RoleRule{{Path: "realm_access.roles"}}},
+    })
+    cookie := authService.ToJWTCookie(&Authentication{
+        ExpiresAt:   expires2099,
+        Authorities: []GrantedAuthority{{Role: "admin", OrgUnits: []OrganizationalUnit{{Id: 21}}}},
+        Extra: map[string]interface{}{
+            "realm_access": map[string]interface{}{"roles": []string{"admin", "user"}},
+        },
+    })
+
+    authentication, err := authService.FromCookie(cookie)
+
+    expected := []GrantedAuthority{{Role: "admin", OrgUnits: []OrganizationalUnit{{Id: 21}}}, {Role: "user"}}
+    if err != nil || !reflect.DeepEqual(authentication.Authorities, expected) {
+        t.Errorf("Expected %+v, got %+v (%v)", expected, authentication.Authorities, err)
+    }
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	"sort"
+)
+
+// reservedClaims are the claim names managed by Authentication itself. They can never be set or overridden
+// through Authentication.Extra.
+var reservedClaims = map[string]bool{
+	"exp":         true,
+	"iat":         true,
+	"nbf":         true,
+	"jti":         true,
+	"aud":         true,
+	"iss":         true,
+	"sub":         true,
+	"name":        true,
+	"username":    true,
+	"authorities": true,
+	"amr":         true,
+	"acr":         true,
+	"auth_time":   true,
+	"client_id":   true,
+	"scope":       true,
+	"cnf":         true,
+	"token_use":   true,
+}
+
+// token use of tokens issued between password check and second factor during login
+const tokenUseMFAPending = "mfa_pending"
+
+// IsReservedClaim tells if a claim name is managed by Authentication and therefore can not be used as an extra claim
+func IsReservedClaim(name string) bool {
+	return reservedClaims[name]
+}
+
+// jwtToken is the payload which is signed into a JWT
+type jwtToken struct {
+	jwt.StandardClaims
+	// takes the place of the aud of StandardClaims, which can only hold a single audience
+	Audience    Audiences          `json:"aud,omitempty"`
+	Name        string             `json:"name,omitempty"`
+	Username    string             `json:"username,omitempty"`
+	Authorities []GrantedAuthority `json:"authorities,omitempty"`
+	AMR         []string           `json:"amr,omitempty"`
+	ACR         string             `json:"acr,omitempty"`
+	AuthTime    int64              `json:"auth_time,omitempty"`
+	ClientID    string             `json:"client_id,omitempty"`
+	Scope       string             `json:"scope,omitempty"`
+	Cnf         *Confirmation      `json:"cnf,omitempty"`
+	// marks tokens for special purposes, which are not accepted as regular authentication
+	TokenUse string `json:"token_use,omitempty"`
+	// custom claims, appended after the known ones
+	extra map[string]interface{}
+}
+
+// newJWTToken maps an Authentication to the claims that will be signed
+func newJWTToken(authentication *Authentication) jwtToken {
+	return jwtToken{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    authentication.Issuer,
+			IssuedAt:  authentication.IssuedAt,
+			Subject:   authentication.Subject,
+			ExpiresAt: authentication.ExpiresAt,
+			NotBefore: authentication.NotBefore,
+			Id:        authentication.ID,
+		},
+		Audience:    authentication.Audience,
+		Name:        authentication.Name,
+		Username:    authentication.Username,
+		Authorities: authentication.Authorities,
+		AMR:         authentication.AuthenticationMethods,
+		ACR:         authentication.AuthenticationContextClass,
+		AuthTime:    authentication.AuthTime,
+		ClientID:    authentication.ClientID,
+		Scope:       authentication.Scope,
+		Cnf:         authentication.Confirmation,
+		extra:       authentication.Extra,
+	}
+}
+
+// MarshalJSON encodes the known claims first, followed by the extra claims sorted by name. Extra claims
+// colliding with a reserved name are skipped, so that they can never override the known ones.
+func (token jwtToken) MarshalJSON() ([]byte, error) {
+	type plainToken jwtToken
+
+	encoded, err := json.Marshal(plainToken(token))
+	if err != nil || len(token.extra) == 0 {
+		return encoded, err
+	}
+
+	names := make([]string, 0, len(token.extra))
+	for name := range token.extra {
+		if !IsReservedClaim(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	// strip the closing brace of the known claims and continue the object from there
+	buffer := bytes.NewBuffer(encoded[:len(encoded)-1])
+	for _, name := range names {
+		encodedName, _ := json.Marshal(name)
+		encodedValue, err := json.Marshal(token.extra[name])
+		if err != nil {
+			return nil, err
+		}
+		if buffer.Len() > 1 {
+			buffer.WriteByte(',')
+		}
+		buffer.Write(encodedName)
+		buffer.WriteByte(':')
+		buffer.Write(encodedValue)
+	}
+	buffer.WriteByte('}')
+
+	return buffer.Bytes(), nil
+}
+
+// extraClaims collects all claims which are not reserved, or nil if there are none
+func extraClaims(claims jwt.MapClaims) map[string]interface{} {
+	var extra map[string]interface{}
+	for name, value := range claims {
+		if IsReservedClaim(name) {
+			continue
+		}
+		if extra == nil {
+			extra = map[string]interface{}{}
+		}
+		extra[name] = value
+	}
+	return extra
+}
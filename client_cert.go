@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+// ClientCertMapper turns a verified client certificate into an Authentication
+type ClientCertMapper func(certificate *x509.Certificate) (*Authentication, error)
+
+// ClientCertAuthenticator authenticates services of the mesh through TLS client certificates. The certificate
+// presented on the connection is verified against the configured CA pool and mapped to an Authentication.
+//
+// The server has to request client certificates, e.g. with tls.VerifyClientCertIfGiven, for them to show up in
+// r.TLS.PeerCertificates.
+type ClientCertAuthenticator struct {
+	Middleware
+
+	roots *x509.CertPool
+	// mapping of certificate fields to the Authentication, DefaultClientCertMapper if nil
+	Mapper ClientCertMapper
+	// binds the Authentication to the certificate through the cnf claim, so that JWTs issued for it are only
+	// accepted over connections authenticated with the same certificate
+	BindTokens bool
+}
+
+// NewClientCertAuthenticator creates a ClientCertAuthenticator accepting certificates issued by one of the roots
+func NewClientCertAuthenticator(roots *x509.CertPool) *ClientCertAuthenticator {
+	authenticator := &ClientCertAuthenticator{roots: roots}
+	authenticator.Middleware = NewMiddleware(authenticator)
+	return authenticator
+}
+
+// FromRequest verifies the client certificate of the connection. Requests without certificate match
+// ErrTokenMissing, certificates not issued by one of the roots ErrInvalidCredentials.
+func (authenticator *ClientCertAuthenticator) FromRequest(r *http.Request) (*Authentication, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, &Error{ErrorCode: TokenMissing, Cause: errors.New("no client certificate")}
+	}
+	certificate := r.TLS.PeerCertificates[0]
+
+	intermediates := x509.NewCertPool()
+	for _, intermediate := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(intermediate)
+	}
+	if _, err := certificate.Verify(x509.VerifyOptions{
+		Roots:         authenticator.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return nil, &Error{ErrorCode: InvalidCredentials, Cause: err}
+	}
+
+	mapper := authenticator.Mapper
+	if mapper == nil {
+		mapper = DefaultClientCertMapper
+	}
+	authentication, err := mapper(certificate)
+	if err != nil {
+		return nil, err
+	}
+	if authentication == nil {
+		return nil, ErrInvalidCredentials
+	}
+	if authenticator.BindTokens {
+		authentication.Confirmation = &Confirmation{CertificateThumbprint: CertificateThumbprint(certificate)}
+	}
+	return authentication, nil
+}
+
+// DefaultClientCertMapper uses the first URI SAN (e.g. a SPIFFE ID) or else the common name as Subject, the common
+// name or else the first DNS SAN as Username, and grants each organizational unit of the subject as role.
+func DefaultClientCertMapper(certificate *x509.Certificate) (*Authentication, error) {
+	var authentication Authentication
+
+	authentication.Subject = certificate.Subject.CommonName
+	if len(certificate.URIs) > 0 {
+		authentication.Subject = certificate.URIs[0].String()
+	}
+	authentication.Username = certificate.Subject.CommonName
+	if authentication.Username == "" && len(certificate.DNSNames) > 0 {
+		authentication.Username = certificate.DNSNames[0]
+	}
+	if authentication.Subject == "" {
+		authentication.Subject = authentication.Username
+	}
+	if authentication.Subject == "" {
+		return nil, &Error{ErrorCode: InvalidCredentials, Cause: errors.New("client certificate names no subject")}
+	}
+
+	for _, unit := range certificate.Subject.OrganizationalUnit {
+		authentication.Authorities = append(authentication.Authorities, GrantedAuthority{Role: unit})
+	}
+	return &authentication, nil
+}
+
+// CertificateThumbprint returns the base64url encoded SHA-256 thumbprint of a certificate, as used in the x5t#S256
+// confirmation
+func CertificateThumbprint(certificate *x509.Certificate) string {
+	thumbprint := sha256.Sum256(certificate.Raw)
+	return base64.RawURLEncoding.EncodeToString(thumbprint[:])
+}
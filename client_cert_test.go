@@ -0,0 +1,144 @@
+package auth
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "errors"
+    "math/big"
+    "net/url"
+    "testing"
+    "time"
+)
+
+// newTestCertificate creates a certificate signed by the parent, or a self signed CA if there is none
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template.SerialNumber = big.NewInt(time.Now().UnixNano())
+    template.NotBefore = time.Now().Add(-time.Hour)
+    template.NotAfter = time.Now().Add(time.Hour)
+    if parent == nil {
+        template.IsCA = true
+        template.BasicConstraintsValid = true
+        template.KeyUsage = x509.KeyUsageCertSign
+        parent, parentKey = template, key
+    } else {
+        template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    certificate, err := x509.ParseCertificate(der)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return certificate, key
+}
+
+func newTestClientCertificates(t *testing.T) (*x509.CertPool, *x509.Certificate, *x509.Certificate) {
+    ca, caKey := newTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "mesh CA"}}, nil, nil)
+    spiffeID, _ := url.Parse("spiffe://mesh/billing")
+    client, _ := newTestCertificate(t, &x509.Certificate{
+        Subject: pkix.Name{CommonName: "billing", OrganizationalUnit: []string{"INTERNAL"}},
+        URIs:    []*url.URL{spiffeID},
+    }, ca, caKey)
+
+    rogueCA, rogueKey := newTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "rogue CA"}}, nil, nil)
+    rogue, _ := newTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "billing"}}, rogueCA, rogueKey)
+
+    roots := x509.NewCertPool()
+    roots.AddCert(ca)
+    return roots, client, rogue
+}
+
+func TestClientCertAuthentication(t *testing.T) {
+    roots, client, rogue := newTestClientCertificates(t)
+    authenticator := NewClientCertAuthenticator(roots)
+
+    cases := map[string]struct {
+        certificate   *x509.Certificate
+        expectedError error
+    }{
+        "certificate of the mesh":  {certificate: client},
+        "certificate of other CA":  {certificate: rogue, expectedError: ErrInvalidCredentials},
+        "no certificate presented": {expectedError: ErrTokenMissing},
+    }
+
+    for name, c := range cases {
+        req, _ := newRequestResponseEmulation(t)
+        if c.certificate != nil {
+            req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{c.certificate}}
+        }
+
+        authentication, err := authenticator.FromRequest(req)
+
+        if c.expectedError != nil && !errors.Is(err, c.expectedError) {
+            t.Errorf("%s: expected %v, got %v", name, c.expectedError, err)
+        }
+        if c.expectedError == nil {
+            if err != nil {
+                t.Fatalf("%s: unexpected error %s", name, err)
+            }
+            if authentication.Subject != "spiffe://mesh/billing" || authentication.Username != "billing" ||
+                len(authentication.Authorities) != 1 || authentication.Authorities[0].Role != "INTERNAL" {
+                t.Errorf("%s: unexpected authentication %v", name, authentication)
+            }
+        }
+    }
+}
+
+func TestTokensBoundToClientCertificate(t *testing.T) {
+    roots, client, rogue := newTestClientCertificates(t)
+    authenticator := NewClientCertAuthenticator(roots)
+    authenticator.BindTokens = true
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+        JWTCookieName: "JWT",
+    })
+
+    req, _ := newRequestResponseEmulation(t)
+    req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client}}
+    authentication, err := authenticator.FromRequest(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    authentication.ExpiresAt = expires2099
+    cookie, err := authService.IssueCookie(authentication)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cases := map[string]struct {
+        certificate   *x509.Certificate
+        expectedError error
+    }{
+        "same certificate":  {certificate: client},
+        "other certificate": {certificate: rogue, expectedError: ErrBindingMismatch},
+        "no certificate":    {expectedError: ErrBindingMismatch},
+    }
+
+    for name, c := range cases {
+        req, _ := newRequestResponseEmulation(t)
+        req.AddCookie(cookie)
+        if c.certificate != nil {
+            req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{c.certificate}}
+        }
+
+        parsed, err := authService.FromRequest(req)
+
+        if c.expectedError != nil && !errors.Is(err, c.expectedError) {
+            t.Errorf("%s: expected %v, got %v", name, c.expectedError, err)
+        }
+        if c.expectedError == nil && (err != nil || parsed.Confirmation.CertificateThumbprint != CertificateThumbprint(client)) {
+            t.Errorf("%s: unexpected authentication %v (%v)", name, parsed, err)
+        }
+    }
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/martinreus/auth-middleware"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// configFlags are the flags of all commands needing the configuration of the service. Settings are read like by
+// auth.LoadConfig, from the config file and the AUTH_* environment variables; the key flags override both.
+type configFlags struct {
+	configFile *string
+	key        *string
+	keyFile    *string
+}
+
+func addConfigFlags(flags *flag.FlagSet) configFlags {
+	return configFlags{
+		configFile: flags.String("config-file", "", "JSON or YAML file holding the auth.Config of the service"),
+		key:        flags.String("key", "", "HMAC signing key"),
+		keyFile:    flags.String("key-file", "", "file holding the HMAC signing key, a PEM private key or a key set written by rotate"),
+	}
+}
+
+func (c configFlags) load() (auth.Config, error) {
+	var files []string
+	if *c.configFile != "" {
+		files = append(files, *c.configFile)
+	}
+	config, err := auth.ReadConfig(files...)
+	if err != nil {
+		return config, err
+	}
+
+	switch {
+	case *c.key != "" && *c.keyFile != "":
+		return config, errors.New("only one of -key and -key-file may be given")
+	case *c.key != "":
+		config.JWTPrivateKey, config.KeySet = []byte(*c.key), nil
+	case *c.keyFile != "":
+		if config.JWTPrivateKey, config.KeySet, err = auth.ReadKeyFile(*c.keyFile); err != nil {
+			return config, err
+		}
+	}
+	// unlike services, the tool does not insist on strong keys, e.g. to inspect tokens of test setups
+	if len(config.JWTPrivateKey) == 0 {
+		return config, errors.New("a signing key is required (-key, -key-file, AUTH_JWT_PRIVATE_KEY or -config-file)")
+	}
+	return config, nil
+}
+
+// outputFlags select how issued tokens are printed
+type outputFlags struct {
+	output *string
+	url    *string
+}
+
+func addOutputFlags(flags *flag.FlagSet) outputFlags {
+	return outputFlags{
+		output: flags.String("output", "token", "print the token, the Set-Cookie header line (cookie) or a curl command (curl)"),
+		url:    flags.String("url", "http://localhost:8080/", "URL of the curl command"),
+	}
+}
+
+func (o outputFlags) validate() error {
+	switch *o.output {
+	case "token", "cookie", "curl":
+		return nil
+	}
+	return fmt.Errorf("unknown output %q; expected token, cookie or curl", *o.output)
+}
+
+// print writes the issued cookies in the selected format. The first cookie holds the token, a second one the
+// fingerprint, if configured.
+func (o outputFlags) print(stdout io.Writer, cookies []*http.Cookie) {
+	switch *o.output {
+	case "cookie":
+		for _, cookie := range cookies {
+			fmt.Fprintf(stdout, "Set-Cookie: %s\n", cookie.String())
+		}
+	case "curl":
+		var pairs []string
+		for _, cookie := range cookies {
+			pairs = append(pairs, cookie.Name+"="+cookie.Value)
+		}
+		fmt.Fprintf(stdout, "curl --cookie %s %s\n", shellQuote(strings.Join(pairs, "; ")), shellQuote(*o.url))
+	default:
+		fmt.Fprintln(stdout, cookies[0].Value)
+	}
+}
+
+// --------------------------
+// private stuff
+// --------------------------
+
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
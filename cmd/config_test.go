@@ -0,0 +1,61 @@
+package main
+
+import (
+    "encoding/base64"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+const testKey = "a-signing-key-long-enough-for-hs512-0123456789-0123456789-0123456789"
+
+func TestSignHonoursConfigFile(t *testing.T) {
+    configFile := filepath.Join(t.TempDir(), "auth.json")
+    // the key is base64 encoded in JSON, as for the service
+    config := `{"jwtPrivateKey": "c2VjcmV0", "issuer": "Production", "cookieName": "SESSION", "expiresIn": 60}`
+    if err := os.WriteFile(configFile, []byte(config), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    code, cookie, stderr := execute("", "sign", "-config-file", configFile, "-sub", "marty", "-output", "cookie")
+    if code != 0 {
+        t.Fatalf("sign failed: %s", stderr)
+    }
+    if !strings.HasPrefix(cookie, "Set-Cookie: SESSION=") || !strings.Contains(cookie, "HttpOnly") {
+        t.Errorf("Unexpected cookie %s", cookie)
+    }
+
+    token := strings.TrimPrefix(strings.Split(cookie, ";")[0], "Set-Cookie: SESSION=")
+    code, claims, stderr := execute("", "verify", "-config-file", configFile, token)
+    if code != 0 || !strings.Contains(claims, `"iss": "Production"`) {
+        t.Errorf("token should carry the issuer of the config, got %s (%s)", claims, stderr)
+    }
+    if code, _, _ := execute("", "verify", "-key", "secret", token); code != 1 {
+        t.Error("token should not verify against the default issuer")
+    }
+}
+
+func TestSignHonoursEnvironment(t *testing.T) {
+    t.Setenv("AUTH_JWT_PRIVATE_KEY", base64.StdEncoding.EncodeToString([]byte(testKey)))
+    t.Setenv("AUTH_COOKIE_NAME", "SESSION")
+    t.Setenv("AUTH_FINGERPRINT_COOKIE_NAME", "__Secure-Fgp")
+
+    code, curl, stderr := execute("", "sign", "-sub", "marty", "-output", "curl", "-url", "https://api.example.com/me")
+    if code != 0 {
+        t.Fatalf("sign failed: %s", stderr)
+    }
+
+    if !strings.HasPrefix(curl, "curl --cookie 'SESSION=") || !strings.Contains(curl, "; __Secure-Fgp=") ||
+        !strings.HasSuffix(curl, " 'https://api.example.com/me'") {
+        t.Errorf("Unexpected curl command %s", curl)
+    }
+}
+
+func TestSignWithoutKey(t *testing.T) {
+    code, _, stderr := execute("", "sign", "-sub", "marty")
+
+    if code != 1 || !strings.Contains(stderr, "signing key is required") {
+        t.Errorf("sign should ask for a key, got %d: %s", code, stderr)
+    }
+}
@@ -5,24 +5,30 @@ import (
 	"flag"
 	"fmt"
 	"github.com/martinreus/auth-middleware"
+	"io"
 	"os"
+	"strings"
 )
 
+// Config is the auth.Config of the service, with the private key optionally given as text
 type Config struct {
-    PrivateKey string
+	auth.Config
+	// takes precedence over jwtPrivateKey, which is base64 encoded
+	PrivateKey string
 }
 
 type JWTGenerateModel struct {
-	// has the configuration for this authentication service. Only private key needs to be provided
+	// has the configuration for this authentication service. Only private key needs to be provided, anything else
+	// defaults to DefaultAuthConfig.
 	Config Config `json:"config"`
 	// has the model wich will be converted to a JWT Token.
 	Payload auth.Authentication `json:"payload"`
 }
 
-
 var exampleModel = JWTGenerateModel{
 	Config: Config{
-        PrivateKey: "privateKey",
+		Config:     auth.Config{Issuer: "anIssuer", TokenExpiresIn: 300},
+		PrivateKey: "privateKey",
 	},
 	Payload: auth.Authentication{
 		Issuer: "anIssuer",
@@ -40,27 +46,87 @@ var exampleModel = JWTGenerateModel{
 	},
 }
 
+const usage = `Usage: jwt_generator <command> [flags] [token]
+
+Commands:
+  sign     sign a token from flags or a JSON payload (file or - for stdin)
+  verify   check signature and expiracy of a token with a key, and print its claims
+  decode   print header and claims of a token without verifying it
+  refresh  issue a refreshed token for a valid or expired token
+  keygen   generate an HMAC secret, or an RSA, EC or Ed25519 key pair as PEM
+  jwks     export public keys of PEM files or a key set as JSON Web Key Set
+  rotate   add a new active key to a key set file, retiring the current one
+
+Run jwt_generator <command> -h for the flags of a command. Without command, the -config flag of former versions is
+still understood.
+`
+
 func main() {
-	configuration := flag.String("config", "", "Configuration for generating a JWT token")
-	flag.Parse()
-	if configuration == nil || *configuration == "" {
-        bytes, _ := json.Marshal(exampleModel)
-        fmt.Println(
-		    fmt.Sprintf("Please provide a valid configuration for generating a JWT. A Valid example could be: %s. \nFind out more with -h flag", string(bytes)))
-		os.Exit(0)
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run executes the command line and returns the exit code
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 || strings.HasPrefix(strings.TrimLeft(args[0], "-"), "config") {
+		return generate(args, stdout, stderr)
+	}
+
+	commands := map[string]func(args []string, stdin io.Reader, stdout, stderr io.Writer) int{
+		"sign":    sign,
+		"verify":  verify,
+		"decode":  decode,
+		"refresh": refresh,
+		"keygen":  keygen,
+		"jwks":    jwks,
+		"rotate":  rotate,
+	}
+	command, found := commands[args[0]]
+	if !found {
+		fmt.Fprint(stderr, usage)
+		if args[0] == "help" || args[0] == "-h" || args[0] == "-help" {
+			return 0
+		}
+		return 2
+	}
+	return command(args[1:], stdin, stdout, stderr)
+}
+
+// generate is the original single JSON -config mode
+func generate(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("jwt_generator", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configuration := flags.String("config", "", "Configuration for generating a JWT token")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *configuration == "" {
+		bytes, _ := json.Marshal(exampleModel)
+		fmt.Fprintf(stdout, "Please provide a valid configuration for generating a JWT. A Valid example could be: %s. \nFind out more with -h flag\n", string(bytes))
+		fmt.Fprint(stdout, "\n"+usage)
+		return 0
 	}
 
-	var jwtConfig JWTGenerateModel
+	jwtConfig := JWTGenerateModel{Config: Config{Config: auth.DefaultAuthConfig(nil)}}
 
 	if err := json.Unmarshal([]byte(*configuration), &jwtConfig); err != nil {
-		fmt.Println(fmt.Sprintf("Unable to unmarshal %s", *configuration))
-		os.Exit(1)
+		fmt.Fprintf(stderr, "Unable to unmarshal %s\n", *configuration)
+		return 1
+	}
+	if jwtConfig.Config.PrivateKey != "" {
+		jwtConfig.Config.JWTPrivateKey = []byte(jwtConfig.Config.PrivateKey)
+	}
+	if jwtConfig.Payload.Issuer == "" {
+		jwtConfig.Payload.Issuer = jwtConfig.Config.Issuer
 	}
 
-    authService := auth.New(auth.Config{JWTPrivateKey: []byte(jwtConfig.Config.PrivateKey)})
+	authService := auth.New(jwtConfig.Config.Config)
 
-    cookie := authService.ToJWTCookie(&jwtConfig.Payload)
+	cookie, err := authService.IssueCookie(&jwtConfig.Payload)
+	if err != nil {
+		return fail(stderr, err)
+	}
 
-    fmt.Println("Generated Token:")
-    fmt.Println(fmt.Sprintf("%s", cookie.Value))
+	fmt.Fprintln(stdout, "Generated Token:")
+	fmt.Fprintln(stdout, cookie.Value)
+	return 0
 }
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/martinreus/auth-middleware"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// generationFlags are the flags of all commands generating keys
+type generationFlags struct {
+	keyType *string
+	bits    *int
+	curve   *string
+}
+
+func addGenerationFlags(flags *flag.FlagSet) generationFlags {
+	return generationFlags{
+		keyType: flags.String("type", "hmac", "type of the key: hmac, rsa, ec or ed25519"),
+		bits:    flags.Int("bits", 3072, "size of RSA keys"),
+		curve:   flags.String("curve", "P-256", "curve of EC keys: P-256, P-384 or P-521"),
+	}
+}
+
+// generate creates an HMAC secret, or a private key for the other types
+func (g generationFlags) generate() ([]byte, crypto.Signer, error) {
+	switch *g.keyType {
+	case "hmac":
+		// encoded, so that the secret can be handled as text; still longer than auth.MinHMACKeyLength
+		random := make([]byte, auth.MinHMACKeyLength)
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, err
+		}
+		return []byte(base64.RawURLEncoding.EncodeToString(random)), nil, nil
+	case "rsa":
+		if *g.bits < 2048 {
+			return nil, nil, errors.New("RSA keys need at least 2048 bits")
+		}
+		key, err := rsa.GenerateKey(rand.Reader, *g.bits)
+		return nil, key, err
+	case "ec":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, found := curves[*g.curve]
+		if !found {
+			return nil, nil, fmt.Errorf("unsupported curve %q", *g.curve)
+		}
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		return nil, key, err
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return nil, key, err
+	}
+	return nil, nil, fmt.Errorf("unsupported key type %q", *g.keyType)
+}
+
+func keygen(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	generation := addGenerationFlags(flags)
+	out := flags.String("out", "", "write the key to this file instead of stdout; public keys go to <out>.pub")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	secret, privateKey, err := generation.generate()
+	if err != nil {
+		return fail(stderr, fmt.Errorf("unable to generate key: %w", err))
+	}
+
+	var private, public []byte
+	if secret != nil {
+		private = append(secret, '\n')
+	} else if private, public, err = encodeKeyPair(privateKey); err != nil {
+		return fail(stderr, err)
+	}
+
+	if *out == "" {
+		stdout.Write(private)
+		stdout.Write(public)
+		return 0
+	}
+	if err := os.WriteFile(*out, private, 0600); err != nil {
+		return fail(stderr, fmt.Errorf("unable to write key: %w", err))
+	}
+	if public != nil {
+		if err := os.WriteFile(*out+".pub", public, 0644); err != nil {
+			return fail(stderr, fmt.Errorf("unable to write public key: %w", err))
+		}
+	}
+	return 0
+}
+
+func jwks(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("jwks", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	keySetFile := flags.String("keyset", "", "key set file maintained by the rotate command")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *keySetFile == "" && flags.NArg() == 0 {
+		return fail(stderr, errors.New("expected PEM files or -keyset"))
+	}
+
+	set := auth.JSONWebKeySet{Keys: []auth.JSONWebKey{}}
+	seen := map[string]bool{}
+	add := func(key auth.JSONWebKey) {
+		if !seen[key.KeyID] {
+			seen[key.KeyID] = true
+			set.Keys = append(set.Keys, key)
+		}
+	}
+
+	if *keySetFile != "" {
+		keys, err := readKeySet(*keySetFile)
+		if err != nil {
+			return fail(stderr, err)
+		}
+		// secrets are never published
+		publicKeys, err := keys.PublicKeys()
+		if err != nil {
+			return fail(stderr, fmt.Errorf("invalid key set %s: %w", *keySetFile, err))
+		}
+		for _, key := range publicKeys.Keys {
+			add(key)
+		}
+	}
+	for _, path := range flags.Args() {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fail(stderr, fmt.Errorf("unable to read %s: %w", path, err))
+		}
+		publicKeys, err := parsePEMKeys(content)
+		for _, publicKey := range publicKeys {
+			var key auth.JSONWebKey
+			if key, err = publicJSONWebKey(publicKey); err != nil {
+				break
+			}
+			add(key)
+		}
+		if err != nil {
+			return fail(stderr, fmt.Errorf("invalid key in %s: %w", path, err))
+		}
+	}
+
+	printJSON(stdout, set)
+	return 0
+}
+
+func rotate(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("rotate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	generation := addGenerationFlags(flags)
+	keySetFile := flags.String("keyset", "", "key set file to add the new key to; created if missing")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *keySetFile == "" {
+		return fail(stderr, errors.New("-keyset is required"))
+	}
+
+	keys := &auth.KeySet{}
+	if _, err := os.Stat(*keySetFile); err == nil {
+		if keys, err = readKeySet(*keySetFile); err != nil {
+			return fail(stderr, err)
+		}
+	}
+
+	secret, privateKey, err := generation.generate()
+	if err != nil {
+		return fail(stderr, fmt.Errorf("unable to generate key: %w", err))
+	}
+	var entry auth.KeySetEntry
+	if privateKey != nil {
+		if entry, err = auth.NewKeySetEntry(privateKey); err != nil {
+			return fail(stderr, err)
+		}
+	} else {
+		random := make([]byte, 8)
+		if _, err := rand.Read(random); err != nil {
+			return fail(stderr, err)
+		}
+		entry = auth.KeySetEntry{
+			KeyID:     hex.EncodeToString(random),
+			Type:      "hmac",
+			Status:    auth.KeyStatusActive,
+			CreatedAt: time.Now().Unix(),
+			Key:       string(secret),
+		}
+	}
+
+	for i := range keys.Keys {
+		if keys.Keys[i].Status == auth.KeyStatusActive {
+			keys.Keys[i].Status = auth.KeyStatusRetired
+			keys.Keys[i].RetiredAt = entry.CreatedAt
+		}
+	}
+	keys.Keys = append(keys.Keys, entry)
+
+	if err := writeKeySet(*keySetFile, keys); err != nil {
+		return fail(stderr, err)
+	}
+	fmt.Fprintln(stdout, entry.KeyID)
+	return 0
+}
+
+// --------------------------
+// private stuff
+// --------------------------
+
+// encodeKeyPair returns the PKCS #8 private and the PKIX public key as PEM
+func encodeKeyPair(privateKey crypto.Signer) ([]byte, []byte, error) {
+	private, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to encode private key: %w", err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(privateKey.Public())
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to encode public key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), nil
+}
+
+// parsePEMKeys returns the public keys of all PEM blocks, whether they hold private or public keys
+func parsePEMKeys(content []byte) ([]crypto.PublicKey, error) {
+	var publicKeys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if signer, ok := key.(crypto.Signer); ok {
+			key = signer.Public()
+		}
+		publicKeys = append(publicKeys, key)
+	}
+	if len(publicKeys) == 0 {
+		return nil, errors.New("no PEM encoded key found")
+	}
+	return publicKeys, nil
+}
+
+// publicJSONWebKey encodes a public key for signature verification, with its JWK thumbprint as key ID, which is the
+// key ID rotate and the services give to the key as well
+func publicJSONWebKey(publicKey crypto.PublicKey) (auth.JSONWebKey, error) {
+	key, err := auth.NewJSONWebKey(publicKey)
+	if err != nil {
+		return key, err
+	}
+	key.KeyID, err = key.Thumbprint()
+	return key, err
+}
+
+func readKeySet(path string) (*auth.KeySet, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key set: %w", err)
+	}
+	keys, err := auth.ParseKeySet(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key set %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// writeKeySet replaces the key set file atomically, readable by the owner only
+func writeKeySet(path string, keys *auth.KeySet) error {
+	content, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode key set: %w", err)
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("unable to write key set: %w", err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(append(content, '\n')); err != nil {
+		file.Close()
+		return fmt.Errorf("unable to write key set: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("unable to write key set: %w", err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("unable to write key set: %w", err)
+	}
+	return nil
+}
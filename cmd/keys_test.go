@@ -0,0 +1,130 @@
+package main
+
+import (
+    "encoding/json"
+    "github.com/martinreus/auth-middleware"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestKeygenHMACSecretSignsTokens(t *testing.T) {
+    keyFile := filepath.Join(t.TempDir(), "key.txt")
+    if code, _, stderr := execute("", "keygen", "-out", keyFile); code != 0 {
+        t.Fatalf("keygen failed: %s", stderr)
+    }
+    if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+        t.Fatalf("secret should only be readable by its owner, got %v (%v)", info, err)
+    }
+    key, _ := os.ReadFile(keyFile)
+    config := auth.DefaultAuthConfig([]byte(strings.TrimSpace(string(key))))
+    if err := config.Validate(); err != nil {
+        t.Errorf("generated secret should be a valid key, got %s", err)
+    }
+
+    _, token, _ := execute("", "sign", "-key-file", keyFile, "-sub", "marty")
+    if code, _, stderr := execute("", "verify", "-key-file", keyFile, token); code != 0 {
+        t.Errorf("token signed with generated secret should verify, got %s", stderr)
+    }
+}
+
+func TestKeygenAndJWKSForKeyPairs(t *testing.T) {
+    dir := t.TempDir()
+    cases := map[string][]string{
+        "RSA":     {"-type", "rsa", "-bits", "2048"},
+        "EC":      {"-type", "ec", "-curve", "P-384"},
+        "Ed25519": {"-type", "ed25519"},
+    }
+
+    for name, flags := range cases {
+        out := filepath.Join(dir, name)
+        if code, _, stderr := execute("", append([]string{"keygen", "-out", out}, flags...)...); code != 0 {
+            t.Fatalf("%s: keygen failed: %s", name, stderr)
+        }
+
+        // private and public key denote the same key
+        code, output, stderr := execute("", "jwks", out, out+".pub")
+        if code != 0 {
+            t.Fatalf("%s: jwks failed: %s", name, stderr)
+        }
+        var set auth.JSONWebKeySet
+        if err := json.Unmarshal([]byte(output), &set); err != nil || len(set.Keys) != 1 {
+            t.Fatalf("%s: expected one key, got %s", name, output)
+        }
+        if _, err := set.Keys[0].PublicKey(); err != nil || set.Keys[0].KeyID == "" || set.Keys[0].Algorithm == "" {
+            t.Errorf("%s: unexpected key %v (%v)", name, set.Keys[0], err)
+        }
+
+        // the private key signs tokens naming the published key
+        _, token, _ := execute("", "sign", "-key-file", out, "-sub", "marty")
+        if code, _, stderr := execute("", "verify", "-key-file", out, token); code != 0 {
+            t.Errorf("%s: token signed with generated key should verify, got %s", name, stderr)
+        }
+        _, header, _ := execute("", "decode", token)
+        if !strings.Contains(header, `"kid": "`+set.Keys[0].KeyID+`"`) || !strings.Contains(header, `"alg": "`+set.Keys[0].Algorithm+`"`) {
+            t.Errorf("%s: token should name the published key, got %s", name, header)
+        }
+    }
+}
+
+func TestRotateRetiresActiveKey(t *testing.T) {
+    keySetFile := filepath.Join(t.TempDir(), "keys.json")
+
+    _, first, _ := execute("", "rotate", "-keyset", keySetFile)
+    _, oldToken, _ := execute("", "sign", "-key-file", keySetFile, "-sub", "marty")
+    code, second, stderr := execute("", "rotate", "-keyset", keySetFile)
+    if code != 0 {
+        t.Fatalf("rotate failed: %s", stderr)
+    }
+
+    keys, err := readKeySet(keySetFile)
+    if err != nil || len(keys.Keys) != 2 {
+        t.Fatalf("expected two keys, got %v (%v)", keys, err)
+    }
+    if keys.Keys[0].KeyID != first || keys.Keys[0].Status != auth.KeyStatusRetired || keys.Keys[0].RetiredAt == 0 {
+        t.Errorf("first key should be retired, got %v", keys.Keys[0])
+    }
+    if keys.Keys[1].KeyID != second || keys.Keys[1].Status != auth.KeyStatusActive {
+        t.Errorf("second key should be active, got %v", keys.Keys[1])
+    }
+    if info, err := os.Stat(keySetFile); err != nil || info.Mode().Perm() != 0600 {
+        t.Errorf("key set should only be readable by its owner, got %v (%v)", info, err)
+    }
+
+    // new tokens name the active key, tokens of the retired key still verify
+    _, newToken, _ := execute("", "sign", "-key-file", keySetFile, "-sub", "marty")
+    _, header, _ := execute("", "decode", newToken)
+    if !strings.Contains(header, `"kid": "`+second+`"`) {
+        t.Errorf("token should name the active key, got %s", header)
+    }
+    for _, token := range []string{oldToken, newToken} {
+        if code, _, stderr := execute("", "verify", "-key-file", keySetFile, token); code != 0 {
+            t.Errorf("token should verify with the key set, got %s", stderr)
+        }
+    }
+}
+
+func TestRotateAsymmetricKeys(t *testing.T) {
+    keySetFile := filepath.Join(t.TempDir(), "keys.json")
+
+    _, first, _ := execute("", "rotate", "-keyset", keySetFile, "-type", "ec")
+    _, oldToken, _ := execute("", "sign", "-key-file", keySetFile, "-sub", "marty")
+    code, second, stderr := execute("", "rotate", "-keyset", keySetFile, "-type", "ed25519")
+    if code != 0 {
+        t.Fatalf("rotate failed: %s", stderr)
+    }
+
+    // retired keys are still published, so that their tokens verify until they expire
+    _, output, _ := execute("", "jwks", "-keyset", keySetFile)
+    if !strings.Contains(output, first) || !strings.Contains(output, second) || strings.Contains(output, "PRIVATE") {
+        t.Errorf("unexpected key set %s", output)
+    }
+
+    _, newToken, _ := execute("", "sign", "-key-file", keySetFile, "-sub", "marty")
+    for _, token := range []string{oldToken, newToken} {
+        if code, _, stderr := execute("", "verify", "-key-file", keySetFile, token); code != 0 {
+            t.Errorf("token should verify with the key set, got %s", stderr)
+        }
+    }
+}
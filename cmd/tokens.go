@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/martinreus/auth-middleware"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+func sign(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("sign", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configuration := addConfigFlags(flags)
+	output := addOutputFlags(flags)
+	payload := flags.String("payload", "", "JSON file holding the Authentication to sign, - for stdin")
+	subject := flags.String("sub", "", "subject")
+	name := flags.String("name", "", "name of the user")
+	username := flags.String("username", "", "username")
+	issuer := flags.String("iss", "", "issuer, defaults to the one of the config")
+	roles := flags.String("roles", "", "comma separated roles")
+	expiresIn := flags.Duration("expires-in", 0, "lifetime of the token, relative to now; defaults to the one of the config")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	config, err := configuration.load()
+	if err == nil {
+		err = output.validate()
+	}
+	if err != nil {
+		return fail(stderr, err)
+	}
+
+	var authentication auth.Authentication
+	if *payload != "" {
+		content, err := readInput(*payload, stdin)
+		if err != nil {
+			return fail(stderr, err)
+		}
+		if err := json.Unmarshal(content, &authentication); err != nil {
+			return fail(stderr, fmt.Errorf("unable to decode payload: %w", err))
+		}
+	}
+
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if set["sub"] {
+		authentication.Subject = *subject
+	}
+	if set["name"] {
+		authentication.Name = *name
+	}
+	if set["username"] {
+		authentication.Username = *username
+	}
+	if set["iss"] {
+		authentication.Issuer = *issuer
+	}
+	if set["roles"] {
+		authentication.Authorities = nil
+		for _, role := range strings.Split(*roles, ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				authentication.Authorities = append(authentication.Authorities, auth.GrantedAuthority{Role: role})
+			}
+		}
+	}
+
+	if authentication.Issuer == "" {
+		authentication.Issuer = config.Issuer
+	}
+	now := time.Now().Unix()
+	if authentication.IssuedAt == 0 {
+		authentication.IssuedAt = now
+	}
+	// an expiracy of the payload wins, unless one is asked for explicitly
+	if set["expires-in"] {
+		authentication.ExpiresAt = now + int64(expiresIn.Seconds())
+	} else if authentication.ExpiresAt == 0 {
+		authentication.ExpiresAt = now + config.TokenExpiresIn
+	}
+
+	cookies, err := auth.New(config).IssueCookies(&authentication)
+	if err != nil {
+		return fail(stderr, err)
+	}
+	output.print(stdout, cookies)
+	return 0
+}
+
+func verify(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configuration := addConfigFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	config, err := configuration.load()
+	if err != nil {
+		return fail(stderr, err)
+	}
+	// tokens only verify if issued by the configured issuer, as tokens of another environment should not
+	config.VerifyIssuer = true
+	token, err := readToken(flags.Args(), stdin)
+	if err != nil {
+		return fail(stderr, err)
+	}
+
+	authentication, err := auth.New(config).FromCookie(&http.Cookie{Value: token})
+	if authentication != nil {
+		printJSON(stdout, authentication)
+	}
+	if err != nil {
+		return fail(stderr, fmt.Errorf("invalid token: %w", err))
+	}
+	fmt.Fprintf(stderr, "Token valid until %s\n", time.Unix(authentication.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	return 0
+}
+
+func decode(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("decode", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	token, err := readToken(flags.Args(), stdin)
+	if err != nil {
+		return fail(stderr, err)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fail(stderr, errors.New("token must consist of three parts"))
+	}
+
+	decoded := map[string]json.RawMessage{}
+	for i, part := range []string{"header", "claims"} {
+		content, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[i], "="))
+		if err != nil || !json.Valid(content) {
+			return fail(stderr, fmt.Errorf("%s is not base64 encoded JSON", part))
+		}
+		decoded[part] = content
+	}
+
+	printJSON(stdout, decoded)
+	fmt.Fprintln(stderr, "Signature NOT verified")
+	return 0
+}
+
+func refresh(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("refresh", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configuration := addConfigFlags(flags)
+	output := addOutputFlags(flags)
+	expiresIn := flags.Duration("expires-in", 0, "lifetime of the refreshed token, relative to now; defaults to the one of the config")
+	maxRenewal := flags.Duration("max-renewal", 0, "how long after being issued a token may be refreshed; defaults to the one of the config")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	config, err := configuration.load()
+	if err == nil {
+		err = output.validate()
+	}
+	if err != nil {
+		return fail(stderr, err)
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "expires-in":
+			config.TokenExpiresIn = int64(expiresIn.Seconds())
+		case "max-renewal":
+			config.MaxRenewalTime = int(maxRenewal.Seconds())
+		}
+	})
+	token, err := readToken(flags.Args(), stdin)
+	if err != nil {
+		return fail(stderr, err)
+	}
+
+	authService := auth.New(config)
+	authentication, err := authService.FromCookie(&http.Cookie{Value: token})
+	if err != nil && !errors.Is(err, auth.ErrTokenExpired) {
+		return fail(stderr, fmt.Errorf("invalid token: %w", err))
+	}
+	refreshed, err := authService.RefreshAuthentication(authentication)
+	if err != nil {
+		return fail(stderr, err)
+	}
+	cookies, err := authService.IssueCookies(refreshed)
+	if err != nil {
+		return fail(stderr, err)
+	}
+	output.print(stdout, cookies)
+	return 0
+}
+
+// --------------------------
+// private stuff
+// --------------------------
+
+// readInput reads a file, or stdin for "-"
+func readInput(path string, stdin io.Reader) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(stdin)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+	return content, nil
+}
+
+// readToken takes the token from the only argument, or from stdin if the argument is "-" or missing
+func readToken(args []string, stdin io.Reader) (string, error) {
+	if len(args) > 1 {
+		return "", errors.New("expected a single token")
+	}
+	if len(args) == 1 && args[0] != "-" {
+		return args[0], nil
+	}
+	content, err := io.ReadAll(stdin)
+	if err != nil {
+		return "", fmt.Errorf("unable to read token: %w", err)
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", errors.New("no token given")
+	}
+	return token, nil
+}
+
+func printJSON(stdout io.Writer, value interface{}) {
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(value)
+}
+
+func fail(stderr io.Writer, err error) int {
+	fmt.Fprintln(stderr, err)
+	return 1
+}
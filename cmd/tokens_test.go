@@ -0,0 +1,106 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "strings"
+    "testing"
+)
+
+// execute runs the command line, returning exit code, stdout and stderr
+func execute(stdin string, args ...string) (int, string, string) {
+    var stdout, stderr bytes.Buffer
+    code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+    return code, strings.TrimSpace(stdout.String()), stderr.String()
+}
+
+func TestSignAndVerify(t *testing.T) {
+    code, token, stderr := execute("", "sign", "-key", "secret", "-sub", "marty", "-roles", "USER, ADMIN", "-expires-in", "1h")
+    if code != 0 {
+        t.Fatalf("sign failed: %s", stderr)
+    }
+
+    code, claims, stderr := execute(token, "verify", "-key", "secret", "-")
+    if code != 0 {
+        t.Fatalf("verify failed: %s", stderr)
+    }
+    var authentication struct {
+        Subject     string `json:"sub"`
+        Authorities []struct {
+            Role string `json:"role"`
+        } `json:"authorities"`
+    }
+    if err := json.Unmarshal([]byte(claims), &authentication); err != nil {
+        t.Fatal(err)
+    }
+    if authentication.Subject != "marty" || len(authentication.Authorities) != 2 || authentication.Authorities[1].Role != "ADMIN" {
+        t.Errorf("Unexpected claims %s", claims)
+    }
+
+    if code, _, _ := execute("", "verify", "-key", "other", token); code != 1 {
+        t.Error("verify should fail with another key")
+    }
+}
+
+func TestSignPayloadFromStdin(t *testing.T) {
+    code, token, stderr := execute(`{"sub": "doc", "exp": 4099716484}`, "sign", "-key", "secret", "-payload", "-")
+    if code != 0 {
+        t.Fatalf("sign failed: %s", stderr)
+    }
+
+    _, decoded, _ := execute("", "decode", token)
+
+    if !strings.Contains(decoded, `"sub": "doc"`) || !strings.Contains(decoded, `"exp": 4099716484`) {
+        t.Errorf("Payload should have been signed as is, got %s", decoded)
+    }
+}
+
+func TestRefreshOfExpiredToken(t *testing.T) {
+    _, expired, _ := execute("", "sign", "-key", "secret", "-sub", "marty", "-expires-in", "-1m")
+    if code, _, _ := execute("", "verify", "-key", "secret", expired); code != 1 {
+        t.Fatal("token should be expired")
+    }
+
+    code, refreshed, stderr := execute(expired, "refresh", "-key", "secret")
+    if code != 0 {
+        t.Fatalf("refresh failed: %s", stderr)
+    }
+
+    if code, _, stderr := execute("", "verify", "-key", "secret", refreshed); code != 0 {
+        t.Errorf("refreshed token should be valid, got %s", stderr)
+    }
+}
+
+func TestDecodeRejectsGarbage(t *testing.T) {
+    if code, _, _ := execute("", "decode", "not-a-token"); code != 1 {
+        t.Error("decode should fail for garbage")
+    }
+}
+
+func TestLegacyConfigFlag(t *testing.T) {
+    code, output, _ := execute("", "-config", `{"config": {"PrivateKey": "secret"}, "payload": {"sub": "marty", "exp": 4099716484}}`)
+    token := output[strings.LastIndex(output, "\n")+1:]
+
+    if code != 0 || !strings.HasPrefix(output, "Generated Token:") {
+        t.Fatalf("Unexpected output %s", output)
+    }
+    if code, _, stderr := execute("", "verify", "-key", "secret", token); code != 0 {
+        t.Errorf("generated token should be valid, got %s", stderr)
+    }
+}
+
+func TestVerifyRejectsBoundToken(t *testing.T) {
+    _, token, _ := execute(`{"sub": "marty", "exp": 4099716484, "cnf": {"jkt": "thumbprint"}}`, "sign", "-key", "secret", "-payload", "-")
+
+    if code, _, stderr := execute("", "verify", "-key", "secret", token); code != 1 || !strings.Contains(stderr, "bound") {
+        t.Errorf("bound token can not be verified without request, got %d: %s", code, stderr)
+    }
+}
+
+func TestLegacyConfigFlagWithoutKey(t *testing.T) {
+    code, output, stderr := execute("", "-config", `{"payload": {"sub": "marty", "exp": 4099716484}}`)
+
+    if code != 1 || strings.Contains(output, "Generated Token:") || !strings.Contains(stderr, "jwtPrivateKey") {
+        t.Errorf("generation without key should fail, got %d: %s %s", code, output, stderr)
+    }
+}
@@ -1,13 +1,50 @@
 package auth
 
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// MinHMACKeyLength is the minimum length in bytes of JWTPrivateKey. HS512 requires a key at least as long as its
+// hash output (RFC 7518, section 3.2).
+const MinHMACKeyLength = 64
+
 type Config struct {
 	JWTPrivateKey []byte `json:"jwtPrivateKey,omitempty"`
+	// file holding the key, a PEM private key or a KeySet whose active key then becomes JWTPrivateKey, read by LoadConfig
+	JWTPrivateKeyFile string `json:"jwtPrivateKeyFile,omitempty"`
+	// keys read from a key set file. The active key signs with its ID as kid header; retired keys still verify.
+	KeySet *KeySet `json:"-"`
 	// expires in seconds. Defaults to 5 minutes.
 	TokenExpiresIn int64  `json:"expiresIn,omitempty"`
 	Issuer         string `json:"issuer,omitempty"`
-	JWTCookieName  string `json:"cookieName,omitempty"`
+	// reject tokens whose issuer differs from Issuer with ErrIssuerMismatch. Off by default, as tokens issued by
+	// former versions may lack the issuer.
+	VerifyIssuer  bool   `json:"verifyIssuer,omitempty"`
+	JWTCookieName string `json:"cookieName,omitempty"`
+	// cookie holding the short lived token between password and second factor during login. Defaults to the
+	// JWTCookieName suffixed with "_MFA".
+	MFACookieName string `json:"mfaCookieName,omitempty"`
 	// max allowed time in seconds, for which an expired token may be renewed. Defaults to one month
 	MaxRenewalTime int `json:"maxRenewalTime,omitempty"`
+	// optional cookie binding JWT cookies to a random fingerprint, e.g. "__Secure-Fgp". The token only carries the
+	// hash of the fingerprint, so a stolen JWT cookie is useless without the hardened fingerprint cookie.
+	FingerprintCookieName string `json:"fingerprintCookieName,omitempty"`
+	// optional mapping of claims of tokens issued by other systems to Authorities. Mapped authorities are added to
+	// the ones found in the "authorities" claim.
+	ClaimMapping *ClaimMapping `json:"claimMapping,omitempty"`
+	// optional check for revoked tokens, e.g. by their ID. Revoked tokens are rejected with ErrRevoked.
+	Revocations RevocationChecker `json:"-"`
+	// optional validation of DPoP proofs. Without it, tokens bound to a DPoP key are rejected.
+	DPoP *DPoPVerifier `json:"-"`
+	// logger of auth decisions and internal errors. Defaults to slog.Default().
+	Logger *slog.Logger `json:"-"`
+}
+
+// RevocationChecker tells whether an otherwise valid authentication has been revoked
+type RevocationChecker interface {
+	IsRevoked(authentication *Authentication) (bool, error)
 }
 
 /**
@@ -27,3 +64,70 @@ func DefaultAuthConfig(privateKey []byte) Config {
 		MaxRenewalTime: 2592000, //one month in seconds
 	}
 }
+
+// Validate checks the config for problems which would lead to unusable or insecure tokens. All problems found are
+// reported at once in a *ConfigError.
+func (config Config) Validate() error {
+	var problems []string
+
+	if len(config.JWTPrivateKey) == 0 {
+		problems = append(problems, "jwtPrivateKey must not be empty")
+	} else if len(config.JWTPrivateKey) < MinHMACKeyLength {
+		problems = append(problems, fmt.Sprintf(
+			"jwtPrivateKey must be at least %d bytes long, got %d", MinHMACKeyLength, len(config.JWTPrivateKey)))
+	}
+	if config.TokenExpiresIn < 0 {
+		problems = append(problems, fmt.Sprintf("expiresIn must not be negative, got %d", config.TokenExpiresIn))
+	}
+	if config.MaxRenewalTime < 0 {
+		problems = append(problems, fmt.Sprintf("maxRenewalTime must not be negative, got %d", config.MaxRenewalTime))
+	}
+	if config.JWTCookieName == "" {
+		problems = append(problems, "cookieName must not be empty")
+	}
+
+	if config.KeySet != nil {
+		for _, entry := range config.KeySet.Keys {
+			if entry.Type == "hmac" {
+				if len(entry.Key) < MinHMACKeyLength {
+					problems = append(problems, fmt.Sprintf(
+						"key %s must be at least %d bytes long, got %d", entry.KeyID, MinHMACKeyLength, len(entry.Key)))
+				}
+			} else if _, err := entry.privateKey(); err != nil {
+				problems = append(problems, fmt.Sprintf("key %s: %s", entry.KeyID, err))
+			}
+			if entry.Status == KeyStatusRetired && entry.RetiredAt <= 0 {
+				problems = append(problems, fmt.Sprintf("retired key %s must have a retiredAt", entry.KeyID))
+			}
+		}
+	}
+
+	if config.DPoP != nil {
+		if config.DPoP.Cache == nil {
+			problems = append(problems, "dpop cache must not be nil")
+		}
+		if config.DPoP.MaxAge < 0 {
+			problems = append(problems, fmt.Sprintf("dpop maxAge must not be negative, got %s", config.DPoP.MaxAge))
+		}
+	}
+
+	if config.ClaimMapping != nil {
+		if err := config.ClaimMapping.Validate(); err != nil {
+			problems = append(problems, err.(*ConfigError).Problems...)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// ConfigError lists all problems found in a Config
+type ConfigError struct {
+	Problems []string
+}
+
+func (err *ConfigError) Error() string {
+	return fmt.Sprintf("invalid auth config: %s", strings.Join(err.Problems, "; "))
+}
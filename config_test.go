@@ -0,0 +1,40 @@
+package auth
+
+import (
+    "strings"
+    "testing"
+)
+
+var validKey = []byte(strings.Repeat("k", MinHMACKeyLength))
+
+func TestDefaultConfigWithLongKeyIsValid(t *testing.T) {
+    if err := DefaultAuthConfig(validKey).Validate(); err != nil {
+        t.Errorf("Default config should be valid, got %s", err)
+    }
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+    config := Config{
+        JWTPrivateKey:  []byte("short"),
+        TokenExpiresIn: -1,
+        MaxRenewalTime: -1,
+    }
+
+    err := config.Validate()
+
+    configError, ok := err.(*ConfigError)
+    if !ok {
+        t.Fatalf("Should have returned a config error, got %v", err)
+    }
+    if len(configError.Problems) != 4 {
+        t.Errorf("Expected 4 problems, got %v", configError.Problems)
+    }
+}
+
+func TestNewServiceRejectsEmptyKey(t *testing.T) {
+    config := DefaultAuthConfig(nil)
+
+    if _, err := NewService(config); err == nil {
+        t.Error("Service should not be created without a key")
+    }
+}
@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// DefaultConfigWatchInterval is how often a ConfigWatcher looks for changes unless configured otherwise
+const DefaultConfigWatchInterval = 10 * time.Second
+
+// ConfigWatcher reloads the config of a service with LoadConfig whenever one of its files changes, e.g. when secrets
+// mounted from files are rotated. The key file, if any, is watched as well. Files are polled by content, so that
+// replaced symlinks and rewritten files with unchanged timestamps are noticed alike.
+//
+// A config which can not be loaded or is invalid is reported to OnError, and the service keeps running with the
+// config it had before.
+//
+// A former key keeps verifying the tokens it signed for the longer of TokenExpiresIn and MaxRenewalTime, so that a
+// rotation does not log out everyone; see KeySet.
+//
+// The key (JWTPrivateKey, JWTPrivateKeyFile and KeySet) is always taken from the files. Settings which can not be read
+// from files (Revocations, DPoP and Logger) are always kept from the service. Any other setting is taken from the
+// files as well, unless the service sets it differently than the files did when the watcher was built, i.e. it has
+// been set in code; such settings, e.g. VerifyIssuer, are kept. A setting owned by the files is cleared when they
+// leave it out.
+type ConfigWatcher struct {
+	service authService
+	paths   []string
+
+	// time between two looks at the files. Defaults to DefaultConfigWatchInterval.
+	Interval time.Duration
+	// called with the errors of reloads, which are logged by the logger of the service if not set
+	OnError func(err error)
+
+	mutex sync.Mutex
+	// key file and hashes of the watched files as of the last reload
+	keyFile string
+	hashes  map[string][32]byte
+	// names of the Config fields set in code, which reloads keep
+	codeOwned []string
+}
+
+// Config fields a ConfigWatcher always takes from the files, and the ones it always keeps as they can not be read
+// from files
+var (
+	fileOwnedFields = map[string]bool{"JWTPrivateKey": true, "JWTPrivateKeyFile": true, "KeySet": true}
+	codeOwnedFields = map[string]bool{"Revocations": true, "DPoP": true, "Logger": true}
+)
+
+// NewConfigWatcher builds a ConfigWatcher reloading this service from the given config files
+func (service authService) NewConfigWatcher(paths ...string) *ConfigWatcher {
+	current := service.current().authConfig
+	watcher := &ConfigWatcher{
+		service: service,
+		paths:   paths,
+		keyFile: current.JWTPrivateKeyFile,
+	}
+	// problems reading the files are reported by the reloads
+	loaded, _ := ReadConfig(paths...)
+	watcher.codeOwned = codeOwned(loaded, current)
+	watcher.hashes = watcher.hashFiles()
+	return watcher
+}
+
+// Run looks for changes until the context is done. Run it in its own goroutine.
+func (watcher *ConfigWatcher) Run(ctx context.Context) {
+	interval := watcher.Interval
+	if interval <= 0 {
+		interval = DefaultConfigWatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := watcher.Check(); err != nil {
+				watcher.reportError(err)
+			}
+		}
+	}
+}
+
+// Check reloads the config if any of the watched files changed since the last reload, telling whether it did. Errors
+// are returned as they are, without calling OnError.
+func (watcher *ConfigWatcher) Check() (bool, error) {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+
+	if !watcher.changed(watcher.hashFiles()) {
+		return false, nil
+	}
+	return true, watcher.reload()
+}
+
+// Reload reloads the config right away, e.g. on SIGHUP
+func (watcher *ConfigWatcher) Reload() error {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+
+	return watcher.reload()
+}
+
+// --------------------------
+// private stuff
+// --------------------------
+
+func (watcher *ConfigWatcher) reload() error {
+	// hashed before loading, so that changes made meanwhile are picked up by the next check
+	hashes := watcher.hashFiles()
+	authConfig, err := ReadConfig(watcher.paths...)
+	if err == nil {
+		current := watcher.service.current()
+		target, source := reflect.ValueOf(&authConfig).Elem(), reflect.ValueOf(current.authConfig)
+		for _, name := range watcher.codeOwned {
+			target.FieldByName(name).Set(source.FieldByName(name))
+		}
+		current.retainKeys(&authConfig, time.Now())
+		// validated only now, as settings the files lack may be made in code
+		err = watcher.service.Reload(authConfig)
+	}
+
+	// a broken config is only reported once, not on every look at the unchanged files
+	if authConfig.JWTPrivateKeyFile != watcher.keyFile {
+		watcher.keyFile = authConfig.JWTPrivateKeyFile
+		hashes = watcher.hashFiles()
+	}
+	watcher.hashes = hashes
+	return err
+}
+
+// hashFiles hashes the config files and the key file. Files which can not be read are left out, so that they count
+// as changed once they can.
+func (watcher *ConfigWatcher) hashFiles() map[string][32]byte {
+	paths := watcher.paths
+	if watcher.keyFile != "" {
+		paths = append(paths[:len(paths):len(paths)], watcher.keyFile)
+	}
+
+	hashes := make(map[string][32]byte, len(paths))
+	for _, path := range paths {
+		if content, err := os.ReadFile(path); err == nil {
+			hashes[path] = sha256.Sum256(content)
+		}
+	}
+	return hashes
+}
+
+func (watcher *ConfigWatcher) changed(hashes map[string][32]byte) bool {
+	if len(hashes) != len(watcher.hashes) {
+		return true
+	}
+	for path, hash := range hashes {
+		if previous, found := watcher.hashes[path]; !found || previous != hash {
+			return true
+		}
+	}
+	return false
+}
+
+// codeOwned returns the names of the fields of the current config which are set in code: those which can not be read
+// from files, and those which differ from the config read from the files. The key is always owned by the files.
+func codeOwned(loaded Config, current Config) []string {
+	loadedValue, currentValue := reflect.ValueOf(loaded), reflect.ValueOf(current)
+	var names []string
+	for i := 0; i < currentValue.NumField(); i++ {
+		name := currentValue.Type().Field(i).Name
+		if fileOwnedFields[name] {
+			continue
+		}
+		if codeOwnedFields[name] || !reflect.DeepEqual(loadedValue.Field(i).Interface(), currentValue.Field(i).Interface()) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (watcher *ConfigWatcher) reportError(err error) {
+	if watcher.OnError != nil {
+		watcher.OnError(err)
+		return
+	}
+	watcher.service.logger().Error("Unable to reload auth config", "error", err)
+}
@@ -0,0 +1,189 @@
+package auth
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestConfigWatcherSwapsRotatedKey(t *testing.T) {
+    configFile, keyFile := writeWatchedConfig(t, validKey)
+    authConfig, err := LoadConfig(configFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // set in code only
+    authConfig.MFACookieName = "SECOND_FACTOR"
+    authService := New(authConfig)
+    handler := authService.IsAuthenticated(&nextHandler{})
+    oldCookie := issueWatchedCookie(authService)
+
+    watcher := authService.NewConfigWatcher(configFile)
+    if changed, err := watcher.Check(); changed || err != nil {
+        t.Fatalf("Nothing should have changed yet, got %t (%v)", changed, err)
+    }
+    writeFile(t, keyFile, []byte(strings.Repeat("r", MinHMACKeyLength)))
+    if changed, err := watcher.Check(); !changed || err != nil {
+        t.Fatalf("Rotated key should have been reloaded, got %t (%v)", changed, err)
+    }
+
+    // middleware built before the reload uses the new key as well
+    newCookie := issueWatchedCookie(authService)
+    if _, err := New(authConfig).FromCookie(newCookie); !errors.Is(err, ErrSignatureInvalid) {
+        t.Errorf("New token should be signed with the new key, got %v", err)
+    }
+    if code := serveWithCookie(handler, newCookie); code != http.StatusOK {
+        t.Errorf("Token signed with the new key should be accepted, got %d", code)
+    }
+    // the former key keeps verifying its tokens, so that nobody gets logged out
+    if code := serveWithCookie(handler, oldCookie); code != http.StatusOK {
+        t.Errorf("Token signed with the former key should still be accepted, got %d", code)
+    }
+    if name := authService.current().mfaCookieName(); name != "SECOND_FACTOR" {
+        t.Errorf("Settings made in code should survive the reload, got MFA cookie %s", name)
+    }
+}
+
+func TestConfigWatcherKeepsSettingsMadeInCode(t *testing.T) {
+    configFile, _ := writeWatchedConfig(t, validKey)
+    writeFile(t, configFile, []byte("issuer: AuthService\njwtPrivateKeyFile: jwt.key\nfingerprintCookieName: __Secure-Fgp\n"))
+    authConfig, _ := LoadConfig(configFile)
+    // set in code only
+    authConfig.VerifyIssuer = true
+    authConfig.TokenExpiresIn = 60
+    authService := New(authConfig)
+    watcher := authService.NewConfigWatcher(configFile)
+
+    writeFile(t, configFile, []byte("issuer: TimeMachine\njwtPrivateKeyFile: jwt.key\n"))
+    if changed, err := watcher.Check(); !changed || err != nil {
+        t.Fatalf("Changed config should have been reloaded, got %t (%v)", changed, err)
+    }
+
+    reloaded := authService.current().authConfig
+    if !reloaded.VerifyIssuer || reloaded.TokenExpiresIn != 60 {
+        t.Errorf("Settings made in code should survive the reload, got %+v", reloaded)
+    }
+    if reloaded.Issuer != "TimeMachine" || reloaded.FingerprintCookieName != "" {
+        t.Errorf("Settings of the files should be taken from them, including cleared ones, got %+v", reloaded)
+    }
+}
+
+func TestConfigWatcherRetiresFormerKeyAfterRenewalTime(t *testing.T) {
+    configFile, keyFile := writeWatchedConfig(t, validKey)
+    authConfig, _ := LoadConfig(configFile)
+    authService := New(authConfig)
+    oldCookie := issueWatchedCookie(authService)
+    watcher := authService.NewConfigWatcher(configFile)
+
+    writeFile(t, keyFile, []byte(strings.Repeat("r", MinHMACKeyLength)))
+    if _, err := watcher.Check(); err != nil {
+        t.Fatal(err)
+    }
+    // as if the renewal time had passed since
+    for i := range authService.current().authConfig.KeySet.Keys {
+        authService.current().authConfig.KeySet.Keys[i].RetiredAt -= int64(authConfig.MaxRenewalTime)
+    }
+
+    if _, err := authService.FromCookie(oldCookie); !errors.Is(err, ErrSignatureInvalid) {
+        t.Errorf("Token of the former key should be rejected after the renewal time, got %v", err)
+    }
+}
+
+func TestConfigWatcherKeepsConfigOnError(t *testing.T) {
+    configFile, keyFile := writeWatchedConfig(t, validKey)
+    authConfig, _ := LoadConfig(configFile)
+    authService := New(authConfig)
+    watcher := authService.NewConfigWatcher(configFile)
+
+    writeFile(t, keyFile, []byte("short"))
+    _, err := watcher.Check()
+
+    var configError *ConfigError
+    if !errors.As(err, &configError) {
+        t.Fatalf("Should have returned a config error, got %v", err)
+    }
+    cookie := issueWatchedCookie(authService)
+    if _, err := New(authConfig).FromCookie(cookie); err != nil {
+        t.Errorf("Service should keep its former key, got %s", err)
+    }
+    if changed, err := watcher.Check(); changed || err != nil {
+        t.Errorf("Broken config should only be reported once, got %t (%v)", changed, err)
+    }
+}
+
+func TestConfigWatcherRunsConcurrentlyWithRequests(t *testing.T) {
+    configFile, keyFile := writeWatchedConfig(t, validKey)
+    authConfig, _ := LoadConfig(configFile)
+    authService := New(authConfig)
+    handler := authService.IsAuthenticated(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+    errs := make(chan error, 1)
+    watcher := authService.NewConfigWatcher(configFile)
+    watcher.Interval = time.Millisecond
+    watcher.OnError = func(err error) {
+        select {
+        case errs <- err:
+        default:
+        }
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go watcher.Run(ctx)
+
+    var wg sync.WaitGroup
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 50; j++ {
+                cookie := issueWatchedCookie(authService)
+                serveWithCookie(handler, cookie)
+            }
+        }()
+    }
+    writeFile(t, keyFile, []byte(strings.Repeat("r", MinHMACKeyLength)))
+    wg.Wait()
+
+    writeFile(t, keyFile, nil)
+    select {
+    case err := <-errs:
+        if !strings.Contains(err.Error(), "jwtPrivateKey") {
+            t.Errorf("Unexpected error %s", err)
+        }
+    case <-time.After(5 * time.Second):
+        t.Error("Reload error should have been reported")
+    }
+}
+
+func issueWatchedCookie(authService authService) *http.Cookie {
+    cookie, _ := authService.IssueCookie(&Authentication{Subject: "marty", Issuer: "AuthService", ExpiresAt: expires2099})
+    return cookie
+}
+
+func writeWatchedConfig(t *testing.T, key []byte) (string, string) {
+    configFile := writeConfigFile(t, "auth.yaml", "issuer: AuthService\njwtPrivateKeyFile: jwt.key\n")
+    keyFile := filepath.Join(filepath.Dir(configFile), "jwt.key")
+    writeFile(t, keyFile, key)
+    return configFile, keyFile
+}
+
+func writeFile(t *testing.T, path string, content []byte) {
+    if err := os.WriteFile(path, content, 0600); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func serveWithCookie(handler http.Handler, cookie *http.Cookie) int {
+    req := httptest.NewRequest(http.MethodGet, "/", nil)
+    req.AddCookie(cookie)
+    rr := httptest.NewRecorder()
+    handler.ServeHTTP(rr, req)
+    return rr.Code
+}
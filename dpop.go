@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DPoPReplayCache remembers the jti of DPoP proofs, so that every proof is only accepted once
+type DPoPReplayCache interface {
+	// Remember stores the jti until the given time. It returns false if the jti is already known.
+	Remember(ctx context.Context, jti string, until time.Time) (bool, error)
+}
+
+// DPoPVerifier validates DPoP proofs (RFC 9449). Tokens bound to a key through cnf.jkt are only accepted together
+// with a fresh proof, signed with that key, for the very request carrying them. Set it as Config.DPoP.
+type DPoPVerifier struct {
+	// required, proofs are refused with ErrInternal without it
+	Cache DPoPReplayCache
+	// how far the iat of a proof may deviate from now, one minute if zero
+	MaxAge time.Duration
+	// URI proofs have to name as htu. Defaults to scheme, host and path of the request, which does not fit servers
+	// behind a proxy rewriting any of these.
+	TargetURI func(r *http.Request) string
+
+	// for tests
+	now func() time.Time
+}
+
+// NewDPoPVerifier creates a DPoPVerifier accepting proofs up to one minute old. Without cache, replays are detected
+// by an InMemoryDPoPReplayCache, which only fits a single instance.
+func NewDPoPVerifier(cache DPoPReplayCache) *DPoPVerifier {
+	if cache == nil {
+		cache = NewInMemoryDPoPReplayCache()
+	}
+	return &DPoPVerifier{
+		Cache:  cache,
+		MaxAge: time.Minute,
+	}
+}
+
+// VerifyProof validates the DPoP header of the request and returns the JWK thumbprint of the proof key. The proof
+// has to carry the hash of the access token as ath, unless accessToken is "", e.g. when a token is issued.
+// Invalid proofs match ErrDPoPProofInvalid, proofs which could not be checked for replay ErrInternal.
+func (verifier *DPoPVerifier) VerifyProof(r *http.Request, accessToken string) (string, error) {
+	proofs := r.Header.Values("DPoP")
+	if len(proofs) != 1 {
+		return "", &Error{ErrorCode: DPoPProofInvalid, Cause: fmt.Errorf("expected one DPoP header, got %d", len(proofs))}
+	}
+
+	var thumbprint string
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.Parse(proofs[0], func(token *jwt.Token) (interface{}, error) {
+		if token.Header["typ"] != "dpop+jwt" {
+			return nil, fmt.Errorf("unexpected type %v", token.Header["typ"])
+		}
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		key, err := proofKey(token.Header["jwk"])
+		if err != nil {
+			return nil, err
+		}
+		if thumbprint, err = key.Thumbprint(); err != nil {
+			return nil, err
+		}
+		return key.PublicKey()
+	})
+	if err != nil || token == nil {
+		return "", &Error{ErrorCode: DPoPProofInvalid, Cause: err}
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if err := verifier.verifyClaims(r, claims, accessToken); err != nil {
+		return "", &Error{ErrorCode: DPoPProofInvalid, Cause: err}
+	}
+
+	if verifier.Cache == nil {
+		return "", &Error{ErrorCode: InternalError, Cause: errors.New("no DPoP replay cache")}
+	}
+	jti := toString(claims["jti"])
+	fresh, err := verifier.Cache.Remember(r.Context(), thumbprint+":"+jti, verifier.currentTime().Add(2*verifier.maxAge()))
+	if err != nil {
+		return "", &Error{ErrorCode: InternalError, Cause: fmt.Errorf("unable to check DPoP proof replay: %w", err)}
+	}
+	if !fresh {
+		return "", &Error{ErrorCode: DPoPProofInvalid, Cause: errors.New("proof replayed")}
+	}
+	return thumbprint, nil
+}
+
+// --------------------------
+// private stuff
+// --------------------------
+
+func (verifier *DPoPVerifier) verifyClaims(r *http.Request, claims jwt.MapClaims, accessToken string) error {
+	if toString(claims["jti"]) == "" {
+		return errors.New("proof has no jti")
+	}
+	if toString(claims["htm"]) != r.Method {
+		return fmt.Errorf("proof is for method %q", toString(claims["htm"]))
+	}
+	if htu := toString(claims["htu"]); htu != verifier.targetURI(r) {
+		return fmt.Errorf("proof is for URI %q", htu)
+	}
+
+	issuedAt := time.Unix(int64(toFloat64(claims["iat"])), 0)
+	if age := verifier.currentTime().Sub(issuedAt); age > verifier.maxAge() || age < -verifier.maxAge() {
+		return errors.New("proof is too old or issued in the future")
+	}
+
+	if accessToken != "" {
+		hash := sha256.Sum256([]byte(accessToken))
+		expected := base64.RawURLEncoding.EncodeToString(hash[:])
+		if subtle.ConstantTimeCompare([]byte(toString(claims["ath"])), []byte(expected)) != 1 {
+			return errors.New("proof is for another access token")
+		}
+	}
+	return nil
+}
+
+func (verifier *DPoPVerifier) maxAge() time.Duration {
+	if verifier.MaxAge <= 0 {
+		return time.Minute
+	}
+	return verifier.MaxAge
+}
+
+func (verifier *DPoPVerifier) targetURI(r *http.Request) string {
+	if verifier.TargetURI != nil {
+		return verifier.TargetURI(r)
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.Path
+}
+
+func (verifier *DPoPVerifier) currentTime() time.Time {
+	if verifier.now != nil {
+		return verifier.now()
+	}
+	return time.Now()
+}
+
+// proofKey decodes the public key a proof is signed with from its jwk header
+func proofKey(header interface{}) (JSONWebKey, error) {
+	var key JSONWebKey
+	members, ok := header.(map[string]interface{})
+	if !ok {
+		return key, errors.New("proof has no jwk header")
+	}
+	if _, private := members["d"]; private {
+		return key, errors.New("proof jwk contains a private key")
+	}
+	encoded, err := json.Marshal(members)
+	if err != nil {
+		return key, err
+	}
+	err = json.Unmarshal(encoded, &key)
+	return key, err
+}
+
+// --------------------------
+// in memory cache
+// --------------------------
+
+// InMemoryDPoPReplayCache is a DPoPReplayCache for a single instance
+type InMemoryDPoPReplayCache struct {
+	mutex     sync.Mutex
+	entries   map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewInMemoryDPoPReplayCache creates an empty InMemoryDPoPReplayCache
+func NewInMemoryDPoPReplayCache() *InMemoryDPoPReplayCache {
+	return &InMemoryDPoPReplayCache{
+		entries: map[string]time.Time{},
+	}
+}
+
+func (cache *InMemoryDPoPReplayCache) Remember(ctx context.Context, jti string, until time.Time) (bool, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	now := time.Now()
+	if expiresAt, found := cache.entries[jti]; found && now.Before(expiresAt) {
+		return false, nil
+	}
+	cache.entries[jti] = until
+
+	// drop expired entries once in a while, so that the map does not grow forever
+	if now.Sub(cache.lastSweep) > time.Minute {
+		for entryKey, expiresAt := range cache.entries {
+			if now.After(expiresAt) {
+				delete(cache.entries, entryKey)
+			}
+		}
+		cache.lastSweep = now
+	}
+	return true, nil
+}
@@ -0,0 +1,224 @@
+package auth
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/tls"
+    "encoding/base64"
+    "errors"
+    "github.com/dgrijalva/jwt-go"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// dpopClient signs DPoP proofs with its own key
+type dpopClient struct {
+    key  *ecdsa.PrivateKey
+    jwk  JSONWebKey
+    jtis int
+}
+
+func newDPoPClient(t *testing.T) *dpopClient {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return &dpopClient{
+        key: key,
+        jwk: JSONWebKey{
+            KeyType: "EC",
+            Curve:   "P-256",
+            X:       base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+            Y:       base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+        },
+    }
+}
+
+func (client *dpopClient) thumbprint(t *testing.T) string {
+    thumbprint, err := client.jwk.Thumbprint()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return thumbprint
+}
+
+func (client *dpopClient) proof(t *testing.T, method, uri, accessToken string, issuedAt time.Time) string {
+    client.jtis++
+    claims := jwt.MapClaims{
+        "jti": "proof-" + strconv.Itoa(client.jtis),
+        "htm": method,
+        "htu": uri,
+        "iat": issuedAt.Unix(),
+    }
+    if accessToken != "" {
+        hash := sha256.Sum256([]byte(accessToken))
+        claims["ath"] = base64.RawURLEncoding.EncodeToString(hash[:])
+    }
+    token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+    token.Header["typ"] = "dpop+jwt"
+    token.Header["jwk"] = map[string]string{"kty": "EC", "crv": "P-256", "x": client.jwk.X, "y": client.jwk.Y}
+    proof, err := token.SignedString(client.key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return proof
+}
+
+func newDPoPRequest(t *testing.T, token, proof string) *http.Request {
+    req, err := http.NewRequest("GET", "https://api.example.com/invoices?page=2", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // as received by a TLS server
+    req.TLS = &tls.ConnectionState{}
+    req.Header.Set("Authorization", "DPoP "+token)
+    if proof != "" {
+        req.Header.Set("DPoP", proof)
+    }
+    return req
+}
+
+func TestJWKThumbprint(t *testing.T) {
+    // example of RFC 7638, section 3.1
+    key := JSONWebKey{
+        KeyType:  "RSA",
+        Exponent: "AQAB",
+        Modulus:  "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+        KeyID:    "2011-04-29",
+    }
+
+    thumbprint, err := key.Thumbprint()
+
+    if err != nil || thumbprint != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+        t.Errorf("Unexpected thumbprint %s (%v)", thumbprint, err)
+    }
+}
+
+func TestDPoPBoundToken(t *testing.T) {
+    client := newDPoPClient(t)
+    attacker := newDPoPClient(t)
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+        JWTCookieName: "JWT",
+        DPoP:          NewDPoPVerifier(NewInMemoryDPoPReplayCache()),
+    })
+    token, err := authService.sign(&Authentication{
+        Subject:      "marty",
+        ExpiresAt:    expires2099,
+        Confirmation: &Confirmation{KeyThumbprint: client.thumbprint(t)},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    uri := "https://api.example.com/invoices"
+    now := time.Now()
+    replayed := client.proof(t, "GET", uri, token, now)
+    _, _ = authService.FromRequest(newDPoPRequest(t, token, replayed))
+
+    cases := map[string]struct {
+        proof         string
+        expectedError error
+    }{
+        "valid proof":           {proof: client.proof(t, "GET", uri, token, now)},
+        "no proof":              {expectedError: ErrDPoPProofInvalid},
+        "replayed proof":        {proof: replayed, expectedError: ErrDPoPProofInvalid},
+        "other method":          {proof: client.proof(t, "POST", uri, token, now), expectedError: ErrDPoPProofInvalid},
+        "other URI":             {proof: client.proof(t, "GET", "https://api.example.com/users", token, now), expectedError: ErrDPoPProofInvalid},
+        "old proof":             {proof: client.proof(t, "GET", uri, token, now.Add(-time.Hour)), expectedError: ErrDPoPProofInvalid},
+        "proof for other token": {proof: client.proof(t, "GET", uri, "other", now), expectedError: ErrDPoPProofInvalid},
+        "proof of other key":    {proof: attacker.proof(t, "GET", uri, token, now), expectedError: ErrBindingMismatch},
+    }
+
+    for name, c := range cases {
+        authentication, err := authService.FromRequest(newDPoPRequest(t, token, c.proof))
+
+        if c.expectedError != nil && !errors.Is(err, c.expectedError) {
+            t.Errorf("%s: expected %v, got %v", name, c.expectedError, err)
+        }
+        if c.expectedError == nil && (err != nil || authentication.Subject != "marty") {
+            t.Errorf("%s: unexpected authentication %v (%v)", name, authentication, err)
+        }
+    }
+}
+
+func TestDPoPBoundTokenWithoutVerifier(t *testing.T) {
+    client := newDPoPClient(t)
+    authService := New(Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+        JWTCookieName: "JWT",
+    })
+    token, _ := authService.sign(&Authentication{
+        ExpiresAt:    expires2099,
+        Confirmation: &Confirmation{KeyThumbprint: client.thumbprint(t)},
+    })
+    proof := client.proof(t, "GET", "https://api.example.com/invoices", token, time.Now())
+
+    _, err := authService.FromRequest(newDPoPRequest(t, token, proof))
+
+    if !errors.Is(err, ErrBindingMismatch) {
+        t.Errorf("Bound token should be rejected without DPoP verifier, got %v", err)
+    }
+}
+
+func TestZeroValueDPoPVerifier(t *testing.T) {
+    client := newDPoPClient(t)
+    config := Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+        JWTCookieName: "JWT",
+        DPoP:          &DPoPVerifier{},
+    }
+    if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "dpop cache") {
+        t.Errorf("DPoP verifier without cache should be rejected, got %v", err)
+    }
+    authService := New(config)
+    token, _ := authService.sign(&Authentication{
+        ExpiresAt:    expires2099,
+        Confirmation: &Confirmation{KeyThumbprint: client.thumbprint(t)},
+    })
+    uri := "https://api.example.com/invoices"
+
+    // a proof of 30 seconds ago is within the default max age, but is not checked for replay without cache
+    _, err := authService.FromRequest(newDPoPRequest(t, token, client.proof(t, "GET", uri, token, time.Now().Add(-30*time.Second))))
+    if !errors.Is(err, ErrInternal) {
+        t.Errorf("Proof should not be accepted without cache, got %v", err)
+    }
+
+    config.DPoP.Cache = NewInMemoryDPoPReplayCache()
+    if _, err := New(config).FromRequest(newDPoPRequest(t, token, client.proof(t, "GET", uri, token, time.Now().Add(-30*time.Second)))); err != nil {
+        t.Errorf("Proof within the default max age should be accepted, got %v", err)
+    }
+    if _, err := New(config).FromRequest(newDPoPRequest(t, token, client.proof(t, "GET", uri, token, time.Now().Add(-2*time.Minute)))); !errors.Is(err, ErrDPoPProofInvalid) {
+        t.Errorf("Proof older than the default max age should be rejected, got %v", err)
+    }
+}
+
+func TestLoginBindsTokenToDPoPKey(t *testing.T) {
+    client := newDPoPClient(t)
+    config := DefaultAuthConfig([]byte("privatesigningpassowrd"))
+    config.DPoP = NewDPoPVerifier(NewInMemoryDPoPReplayCache())
+    service := New(config)
+
+    form := url.Values{"username": {"marty"}, "password": {"delorean"}}
+    req, _ := http.NewRequest("POST", "https://auth.example.com/login", strings.NewReader(form.Encode()))
+    req.TLS = &tls.ConnectionState{}
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.Header.Set("DPoP", client.proof(t, "POST", "https://auth.example.com/login", "", time.Now()))
+    _, rr := newRequestResponseEmulation(t)
+
+    service.LoginHandler(staticVerifier{"marty": "delorean"}).ServeHTTP(rr, req)
+
+    cookie := cookieNamed(rr, "JWT")
+    if rr.Code != http.StatusOK || cookie == nil {
+        t.Fatalf("Login should succeed, got status %d", rr.Code)
+    }
+    authentication, err := service.parseToken(cookie.Value, "")
+    if err != nil || authentication.Confirmation == nil || authentication.Confirmation.KeyThumbprint != client.thumbprint(t) {
+        t.Errorf("Token should be bound to the DPoP key, got %v (%v)", authentication, err)
+    }
+}
@@ -1,17 +1,141 @@
 package auth
 
+import (
+    "fmt"
+    "github.com/dgrijalva/jwt-go"
+)
+
 var (
     MaxRefreshTimeReached = 1
+    TokenMissing          = 2
+    TokenMalformed        = 3
+    TokenUnverifiable     = 4
+    SignatureInvalid      = 5
+    TokenExpired          = 6
+    TokenNotValidYet      = 7
+    IssuerMismatch        = 8
+    Revoked               = 9
+    InvalidCredentials    = 10
+    TooManyAttempts       = 11
+    MFARequired           = 12
+    RecentAuthRequired    = 13
+    AudienceMismatch      = 14
+    TokenInactive         = 15
+    BindingMismatch       = 16
+    DPoPProofInvalid      = 17
+    InternalError         = 18
+)
+
+// Sentinel errors to be used with errors.Is. Errors returned by this package match a sentinel if they carry the
+// same ErrorCode; the underlying cause (e.g. a *jwt.ValidationError) stays reachable through errors.As.
+var (
+    ErrRefreshWindowExceeded = &Error{ErrorCode: MaxRefreshTimeReached}
+    ErrTokenMissing          = &Error{ErrorCode: TokenMissing}
+    ErrTokenMalformed        = &Error{ErrorCode: TokenMalformed}
+    ErrTokenUnverifiable     = &Error{ErrorCode: TokenUnverifiable}
+    ErrSignatureInvalid      = &Error{ErrorCode: SignatureInvalid}
+    ErrTokenExpired          = &Error{ErrorCode: TokenExpired}
+    ErrTokenNotValidYet      = &Error{ErrorCode: TokenNotValidYet}
+    ErrIssuerMismatch        = &Error{ErrorCode: IssuerMismatch}
+    ErrRevoked               = &Error{ErrorCode: Revoked}
+    ErrInvalidCredentials    = &Error{ErrorCode: InvalidCredentials}
+    ErrTooManyAttempts       = &Error{ErrorCode: TooManyAttempts}
+    ErrMFARequired           = &Error{ErrorCode: MFARequired}
+    ErrRecentAuthRequired    = &Error{ErrorCode: RecentAuthRequired}
+    ErrAudienceMismatch      = &Error{ErrorCode: AudienceMismatch}
+    ErrTokenInactive         = &Error{ErrorCode: TokenInactive}
+    ErrBindingMismatch       = &Error{ErrorCode: BindingMismatch}
+    ErrDPoPProofInvalid      = &Error{ErrorCode: DPoPProofInvalid}
+    ErrInternal              = &Error{ErrorCode: InternalError}
 )
 
 type Error struct {
     ErrorCode int
+    // what caused this error, if any
+    Cause error
 }
 
 func (err Error) Error() string {
+    if err.Cause != nil {
+        return fmt.Sprintf("%s: %s", err.message(), err.Cause.Error())
+    }
+    return err.message()
+}
+
+// Is matches any *Error with the same ErrorCode
+func (err Error) Is(target error) bool {
+    if targetError, ok := target.(*Error); ok {
+        return targetError.ErrorCode == err.ErrorCode
+    }
+    return false
+}
+
+func (err Error) Unwrap() error {
+    return err.Cause
+}
+
+func (err Error) message() string {
     switch err.ErrorCode {
     case MaxRefreshTimeReached:
         return "Refresh denied; Max Refresh time reached"
+    case TokenMissing:
+        return "Token missing"
+    case TokenMalformed:
+        return "Token malformed"
+    case TokenUnverifiable:
+        return "Token could not be verified"
+    case SignatureInvalid:
+        return "Token signature invalid"
+    case TokenExpired:
+        return "Token expired"
+    case TokenNotValidYet:
+        return "Token not valid yet"
+    case IssuerMismatch:
+        return "Token issuer mismatch"
+    case Revoked:
+        return "Token revoked"
+    case InvalidCredentials:
+        return "Invalid credentials"
+    case TooManyAttempts:
+        return "Too many attempts"
+    case MFARequired:
+        return "Second factor required"
+    case RecentAuthRequired:
+        return "Login too old; please log in again"
+    case AudienceMismatch:
+        return "Token audience mismatch"
+    case TokenInactive:
+        return "Token inactive"
+    case BindingMismatch:
+        return "Token bound to another certificate or key"
+    case DPoPProofInvalid:
+        return "DPoP proof invalid"
+    case InternalError:
+        return "Internal error"
+    }
+    return "Unknown Error"
+}
+
+// fromValidationError translates errors of the jwt library to an *Error, keeping the original one as cause.
+// When several validations failed, the most severe one wins, e.g. a tampered token which is also expired is
+// reported as having an invalid signature.
+func fromValidationError(err error) *Error {
+    validationError, ok := err.(*jwt.ValidationError)
+    if !ok {
+        return &Error{ErrorCode: TokenMalformed, Cause: err}
+    }
+
+    switch {
+    case validationError.Errors&jwt.ValidationErrorMalformed != 0:
+        return &Error{ErrorCode: TokenMalformed, Cause: err}
+    case validationError.Errors&jwt.ValidationErrorUnverifiable != 0:
+        return &Error{ErrorCode: TokenUnverifiable, Cause: err}
+    case validationError.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+        return &Error{ErrorCode: SignatureInvalid, Cause: err}
+    case validationError.Errors&(jwt.ValidationErrorNotValidYet|jwt.ValidationErrorIssuedAt) != 0:
+        return &Error{ErrorCode: TokenNotValidYet, Cause: err}
+    case validationError.Errors == jwt.ValidationErrorExpired:
+        return &Error{ErrorCode: TokenExpired, Cause: err}
     }
-    return "Unkown Error"
+    return &Error{ErrorCode: TokenMalformed, Cause: err}
 }
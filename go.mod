@@ -3,6 +3,10 @@ module github.com/martinreus/auth-middleware
 require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/mitchellh/mapstructure v1.1.2
+	golang.org/x/crypto v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-go 1.13
+require golang.org/x/sys v0.18.0 // indirect
+
+go 1.21
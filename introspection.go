@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultIntrospectionMaxCacheTime is the time in seconds an introspection result is cached unless configured
+// otherwise
+const DefaultIntrospectionMaxCacheTime = 60
+
+// IntrospectionConfig configures the resolution of opaque tokens through an OAuth2 introspection endpoint (RFC 7662)
+type IntrospectionConfig struct {
+	Endpoint     string `json:"endpoint"`
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+	// upper bound in seconds for caching an introspection result, so that tokens revoked at the authorization
+	// server are noticed. Results are never cached beyond the expiracy of the token. Defaults to
+	// DefaultIntrospectionMaxCacheTime; a negative value disables the cache.
+	MaxCacheTime int64 `json:"maxCacheTime,omitempty"`
+	// client used to talk to the endpoint. Defaults to a client with a 10 seconds timeout.
+	HTTPClient *http.Client `json:"-"`
+}
+
+// IntrospectionService is a Service for opaque bearer tokens. Tokens are resolved through the introspection
+// endpoint, and the claims of the introspection response are turned into an Authentication just like the claims of
+// a JWT, including the ClaimMapping of the Config. Results are cached by token hash for at most MaxCacheTime, and
+// checked against the revocations of the Config on every use.
+//
+// Cookie issuance and refreshes are those of a regular service with the given Config, so that an introspected
+// authentication can be exchanged for a JWT cookie.
+type IntrospectionService struct {
+	Middleware
+
+	config IntrospectionConfig
+	local  authService
+
+	mutex     sync.Mutex
+	cache     map[string]introspectionResult
+	lastSweep time.Time
+}
+
+type introspectionResult struct {
+	authentication Authentication
+	cachedUntil    time.Time
+}
+
+// NewIntrospectionService builds an IntrospectionService
+func NewIntrospectionService(config IntrospectionConfig, authConfig Config) *IntrospectionService {
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if config.MaxCacheTime == 0 {
+		config.MaxCacheTime = DefaultIntrospectionMaxCacheTime
+	}
+	service := &IntrospectionService{
+		config: config,
+		local:  New(authConfig),
+		cache:  map[string]introspectionResult{},
+	}
+	service.Middleware = NewMiddleware(service)
+	return service
+}
+
+// FromRequest resolves the bearer token of the Authorization header
+func (service *IntrospectionService) FromRequest(r *http.Request) (*Authentication, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, ErrTokenMissing
+	}
+	authentication, err := service.Introspect(r.Context(), token)
+	if authentication != nil {
+		if bindingError := service.local.current().verifyBinding(r, token, authentication); bindingError != nil {
+			return nil, bindingError
+		}
+	}
+	return authentication, err
+}
+
+// FromCookie resolves the opaque token held by a cookie. Like for the local service, bound tokens are rejected with
+// ErrBindingMismatch, as their binding can only be verified with the request.
+func (service *IntrospectionService) FromCookie(cookie *http.Cookie) (*Authentication, error) {
+	authentication, err := service.Introspect(context.Background(), cookie.Value)
+	if authentication != nil {
+		if bindingError := verifyUnbound(authentication); bindingError != nil {
+			return nil, bindingError
+		}
+	}
+	return authentication, err
+}
+
+// ToJWTCookie transforms and Authentication into a JWT Cookie of the local service
+func (service *IntrospectionService) ToJWTCookie(authentication *Authentication) *http.Cookie {
+	return service.local.ToJWTCookie(authentication)
+}
+
+// GetClearedJWTCookie gets a blank cookie of the local service
+func (service *IntrospectionService) GetClearedJWTCookie() *http.Cookie {
+	return service.local.GetClearedJWTCookie()
+}
+
+// RefreshAuthentication refreshes Authentication expiracy date like the local service does
+func (service *IntrospectionService) RefreshAuthentication(authentication *Authentication) (*Authentication, error) {
+	return service.local.RefreshAuthentication(authentication)
+}
+
+// Introspect resolves a token, from cache if possible. Inactive tokens are reported with ErrTokenInactive.
+func (service *IntrospectionService) Introspect(ctx context.Context, token string) (*Authentication, error) {
+	hash := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(hash[:])
+
+	authentication := service.cached(key)
+	if authentication == nil {
+		var err error
+		if authentication, err = service.resolve(ctx, token); err != nil {
+			return nil, err
+		}
+		service.store(key, authentication, time.Now())
+	}
+
+	// cached results may have expired or been revoked meanwhile
+	now := time.Now().Unix()
+	if authentication.ExpiresAt != 0 && now >= authentication.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+	if authentication.NotBefore != 0 && now < authentication.NotBefore {
+		return nil, ErrTokenNotValidYet
+	}
+	if err := service.local.current().verifyAuthentication(authentication); err != nil {
+		return nil, err
+	}
+
+	copied := *authentication
+	return &copied, nil
+}
+
+// NewConfigWatcher builds a ConfigWatcher reloading the Config of the local service from the given config files. The
+// IntrospectionConfig is not reloaded.
+func (service *IntrospectionService) NewConfigWatcher(paths ...string) *ConfigWatcher {
+	return service.local.NewConfigWatcher(paths...)
+}
+
+// --------------------------
+// private stuff
+// --------------------------
+
+// logger is the one of the Config of the local service
+func (service *IntrospectionService) logger() *slog.Logger {
+	return service.local.logger()
+}
+
+// resolve introspects a token and turns the claims of an active token into an authentication
+func (service *IntrospectionService) resolve(ctx context.Context, token string) (*Authentication, error) {
+	claims, err := service.introspect(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, ErrTokenInactive
+	}
+
+	authentication, err := service.local.current().constructAuthentication(claims)
+	if err != nil {
+		return nil, &Error{ErrorCode: TokenMalformed, Cause: err}
+	}
+	// "active" and the other introspection specific members are no claims of the token
+	for _, member := range []string{"active", "token_type"} {
+		delete(authentication.Extra, member)
+	}
+	if len(authentication.Extra) == 0 {
+		authentication.Extra = nil
+	}
+	return authentication, nil
+}
+
+func (service *IntrospectionService) introspect(ctx context.Context, token string) (map[string]interface{}, error) {
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, service.config.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.SetBasicAuth(url.QueryEscape(service.config.ClientID), url.QueryEscape(service.config.ClientSecret))
+
+	response, err := service.config.HTTPClient.Do(request)
+	if err != nil {
+		return nil, &Error{ErrorCode: InternalError, Cause: fmt.Errorf("unable to introspect token: %w", err)}
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, &Error{ErrorCode: InternalError, Cause: fmt.Errorf("introspection endpoint returned %d", response.StatusCode)}
+	}
+
+	var claims map[string]interface{}
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&claims); err != nil {
+		return nil, &Error{ErrorCode: InternalError, Cause: fmt.Errorf("unable to decode introspection response: %w", err)}
+	}
+	return claims, nil
+}
+
+func (service *IntrospectionService) cached(key string) *Authentication {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	result, found := service.cache[key]
+	if !found || time.Now().After(result.cachedUntil) {
+		return nil
+	}
+	copied := result.authentication
+	return &copied
+}
+
+func (service *IntrospectionService) store(key string, authentication *Authentication, now time.Time) {
+	if service.config.MaxCacheTime < 0 {
+		return
+	}
+	cachedUntil := now.Add(time.Duration(service.config.MaxCacheTime) * time.Second)
+	if authentication.ExpiresAt != 0 && time.Unix(authentication.ExpiresAt, 0).Before(cachedUntil) {
+		cachedUntil = time.Unix(authentication.ExpiresAt, 0)
+	}
+
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	service.cache[key] = introspectionResult{authentication: *authentication, cachedUntil: cachedUntil}
+
+	// drop expired results once in a while, so that the cache does not grow forever
+	if now.Sub(service.lastSweep) > time.Minute {
+		for cachedKey, result := range service.cache {
+			if now.After(result.cachedUntil) {
+				delete(service.cache, cachedKey)
+			}
+		}
+		service.lastSweep = now
+	}
+}
+
+// bearerToken returns the token of a "Authorization: Bearer <token>" or "Authorization: DPoP <token>" header, or
+// "" if there is none
+func bearerToken(r *http.Request) string {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !(strings.EqualFold(scheme, "Bearer") || strings.EqualFold(scheme, "DPoP")) {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
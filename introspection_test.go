@@ -0,0 +1,246 @@
+package auth
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// newIntrospectionEndpoint answers introspection requests for the token "opaque-marty", counting its calls
+func newIntrospectionEndpoint(t *testing.T, calls *int32) *httptest.Server {
+    return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        atomic.AddInt32(calls, 1)
+        if clientID, clientSecret, _ := r.BasicAuth(); clientID != "gateway" || clientSecret != "secret" {
+            http.Error(w, "unauthorized", http.StatusUnauthorized)
+            return
+        }
+
+        response := map[string]interface{}{"active": false}
+        if r.PostFormValue("token") == "opaque-marty" {
+            response = map[string]interface{}{
+                "active":      true,
+                "sub":         "marty",
+                "username":    "marty",
+                "client_id":   "partner",
+                "aud":         []string{"gateway", "billing"},
+                "exp":         time.Now().Add(time.Hour).Unix(),
+                "authorities": []map[string]string{{"role": "PARTNER"}},
+            }
+        }
+        // a token the client obtained for a user without username, and one the client obtained for itself
+        if token := r.PostFormValue("token"); token == "opaque-emmett" || token == "opaque-partner" {
+            response = map[string]interface{}{
+                "active":    true,
+                "sub":       strings.TrimPrefix(token, "opaque-"),
+                "client_id": "partner",
+                "exp":       time.Now().Add(time.Hour).Unix(),
+            }
+        }
+        if r.PostFormValue("token") == "opaque-doc" {
+            response = map[string]interface{}{
+                "active": true,
+                "sub":    "doc",
+                "nbf":    time.Now().Add(time.Hour).Unix(),
+                "exp":    time.Now().Add(2 * time.Hour).Unix(),
+            }
+        }
+        _ = json.NewEncoder(w).Encode(response)
+    }))
+}
+
+func newTestIntrospectionService(endpoint string) *IntrospectionService {
+    return NewIntrospectionService(IntrospectionConfig{
+        Endpoint:     endpoint,
+        ClientID:     "gateway",
+        ClientSecret: "secret",
+    }, DefaultAuthConfig([]byte("privatesigningpassowrd")))
+}
+
+func TestIntrospectionCachesResults(t *testing.T) {
+    var calls int32
+    endpoint := newIntrospectionEndpoint(t, &calls)
+    defer endpoint.Close()
+    var service Service = newTestIntrospectionService(endpoint.URL)
+
+    for i := 0; i < 3; i++ {
+        req, _ := http.NewRequest("GET", "/", nil)
+        req.Header.Set("Authorization", "Bearer opaque-marty")
+
+        authentication, err := service.FromRequest(req)
+
+        if err != nil || authentication.Username != "marty" || authentication.Authorities[0].Role != "PARTNER" ||
+            !authentication.HasAudience("gateway") {
+            t.Fatalf("Unexpected authentication %+v (%v)", authentication, err)
+        }
+    }
+    if calls != 1 {
+        t.Errorf("Expected a single introspection call, got %d", calls)
+    }
+}
+
+func TestIntrospectionMiddleware(t *testing.T) {
+    var calls int32
+    endpoint := newIntrospectionEndpoint(t, &calls)
+    defer endpoint.Close()
+    service := newTestIntrospectionService(endpoint.URL)
+
+    cases := map[string]struct {
+        authorization string
+        expectedVisit bool
+    }{
+        "active token":   {authorization: "Bearer opaque-marty", expectedVisit: true},
+        "inactive token": {authorization: "Bearer opaque-biff", expectedVisit: false},
+        "no token":       {authorization: "", expectedVisit: false},
+    }
+
+    for name, c := range cases {
+        nextHandler := &nextHandler{}
+        req, rr := newRequestResponseEmulation(t)
+        req.Header.Set("Authorization", c.authorization)
+
+        service.HasAnyRole("PARTNER")(nextHandler).ServeHTTP(rr, req)
+
+        if nextHandler.Visited != c.expectedVisit {
+            t.Errorf("%s: expected next handler visited to be %v", name, c.expectedVisit)
+        }
+    }
+}
+
+func TestIntrospectionTellsServiceAccountsFromUsers(t *testing.T) {
+    var calls int32
+    endpoint := newIntrospectionEndpoint(t, &calls)
+    defer endpoint.Close()
+    service := newTestIntrospectionService(endpoint.URL)
+
+    cases := map[string]struct {
+        token          string
+        serviceAccount bool
+    }{
+        "user token of a client":   {token: "opaque-emmett", serviceAccount: false},
+        "token of a client itself": {token: "opaque-partner", serviceAccount: true},
+    }
+
+    for name, c := range cases {
+        for middleware, expectedVisit := range map[string]bool{"IsServiceAccount": c.serviceAccount, "IsUser": !c.serviceAccount} {
+            nextHandler := &nextHandler{}
+            req, rr := newRequestResponseEmulation(t)
+            req.Header.Set("Authorization", "Bearer "+c.token)
+
+            if middleware == "IsServiceAccount" {
+                service.IsServiceAccount(nextHandler).ServeHTTP(rr, req)
+            } else {
+                service.IsUser(nextHandler).ServeHTTP(rr, req)
+            }
+
+            if nextHandler.Visited != expectedVisit {
+                t.Errorf("%s: expected %s to visit the next handler to be %v", name, middleware, expectedVisit)
+            }
+        }
+    }
+}
+
+func TestIntrospectionEndpointFailureIsNoUnauthorizedRequest(t *testing.T) {
+    endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        http.Error(w, "upstream down", http.StatusBadGateway)
+    }))
+    defer endpoint.Close()
+    var logs bytes.Buffer
+    authConfig := DefaultAuthConfig([]byte("privatesigningpassowrd"))
+    authConfig.Logger = slog.New(slog.NewJSONHandler(&logs, nil))
+    service := NewIntrospectionService(IntrospectionConfig{Endpoint: endpoint.URL}, authConfig)
+
+    nextHandler := &nextHandler{}
+    req, rr := newRequestResponseEmulation(t)
+    req.Header.Set("Authorization", "Bearer opaque-marty")
+    service.IsAuthenticated(nextHandler).ServeHTTP(rr, req)
+
+    if rr.Code != http.StatusInternalServerError || strings.Contains(rr.Body.String(), "502") {
+        t.Errorf("Expected 500 without details, got %d %s", rr.Code, rr.Body.String())
+    }
+    if !strings.Contains(logs.String(), `"level":"ERROR"`) || !strings.Contains(logs.String(), "introspection endpoint returned 502") {
+        t.Errorf("Failure should be logged at error level, got %s", logs.String())
+    }
+}
+
+func TestIntrospectionOfInactiveToken(t *testing.T) {
+    var calls int32
+    endpoint := newIntrospectionEndpoint(t, &calls)
+    defer endpoint.Close()
+
+    _, err := newTestIntrospectionService(endpoint.URL).FromCookie(&http.Cookie{Value: "opaque-biff"})
+
+    if !errors.Is(err, ErrTokenInactive) {
+        t.Errorf("Expected token inactive error, got %v", err)
+    }
+}
+
+func TestIntrospectionChecksRevocationsOfCachedResults(t *testing.T) {
+    var calls int32
+    endpoint := newIntrospectionEndpoint(t, &calls)
+    defer endpoint.Close()
+    var revoked revokedSubjects
+    authConfig := DefaultAuthConfig([]byte("privatesigningpassowrd"))
+    authConfig.Revocations = &revoked
+    service := NewIntrospectionService(IntrospectionConfig{
+        Endpoint:     endpoint.URL,
+        ClientID:     "gateway",
+        ClientSecret: "secret",
+    }, authConfig)
+
+    if _, err := service.FromCookie(&http.Cookie{Value: "opaque-marty"}); err != nil {
+        t.Fatalf("Token should be active, got %v", err)
+    }
+    revoked = append(revoked, "marty")
+
+    if _, err := service.FromCookie(&http.Cookie{Value: "opaque-marty"}); !errors.Is(err, ErrRevoked) {
+        t.Errorf("Expected revoked error for cached result, got %v", err)
+    }
+}
+
+func TestIntrospectionOfTokenNotValidYet(t *testing.T) {
+    var calls int32
+    endpoint := newIntrospectionEndpoint(t, &calls)
+    defer endpoint.Close()
+
+    _, err := newTestIntrospectionService(endpoint.URL).FromCookie(&http.Cookie{Value: "opaque-doc"})
+
+    if !errors.Is(err, ErrTokenNotValidYet) {
+        t.Errorf("Expected token not valid yet error, got %v", err)
+    }
+}
+
+func TestIntrospectionCacheTimeIsCapped(t *testing.T) {
+    service := newTestIntrospectionService("http://localhost")
+    now := time.Now()
+
+    service.store("marty", &Authentication{Subject: "marty", ExpiresAt: now.Add(time.Hour).Unix()}, now)
+
+    expected := now.Add(DefaultIntrospectionMaxCacheTime * time.Second)
+    if cachedUntil := service.cache["marty"].cachedUntil; !cachedUntil.Equal(expected) {
+        t.Errorf("Result should be cached until %v, got %v", expected, cachedUntil)
+    }
+}
+
+func TestIntrospectionServiceReloadsLocalConfig(t *testing.T) {
+    configFile, keyFile := writeWatchedConfig(t, validKey)
+    authConfig, _ := LoadConfig(configFile)
+    service := NewIntrospectionService(IntrospectionConfig{Endpoint: "http://localhost"}, authConfig)
+    watcher := service.NewConfigWatcher(configFile)
+
+    writeFile(t, keyFile, []byte(strings.Repeat("r", MinHMACKeyLength)))
+    if _, err := watcher.Check(); err != nil {
+        t.Fatal(err)
+    }
+
+    cookie := service.ToJWTCookie(&Authentication{Subject: "marty", ExpiresAt: expires2099})
+    if _, err := New(authConfig).FromCookie(cookie); !errors.Is(err, ErrSignatureInvalid) {
+        t.Errorf("Cookies should be signed with the reloaded key, got %v", err)
+    }
+}
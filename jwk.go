@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// JSONWebKey is a public key in JWK format (RFC 7517). Only RSA, EC and Ed25519 (OKP) keys are supported.
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	// RSA
+	Modulus  string `json:"n,omitempty"`
+	Exponent string `json:"e,omitempty"`
+	// EC and OKP
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet is a set of JSONWebKeys, as published by identity providers
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// NewJSONWebKey encodes a *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey for the verification of tokens
+// signed by a KeySet, naming the algorithm it signs with. The key ID is left empty.
+func NewJSONWebKey(publicKey crypto.PublicKey) (JSONWebKey, error) {
+	method := signingMethod(publicKey)
+	if method == nil {
+		return JSONWebKey{}, fmt.Errorf("unsupported key type %T", publicKey)
+	}
+
+	var key JSONWebKey
+	switch publicKey := publicKey.(type) {
+	case *rsa.PublicKey:
+		key = JSONWebKey{
+			KeyType:  "RSA",
+			Modulus:  base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+			Exponent: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		key = JSONWebKey{
+			KeyType: "EC",
+			Curve:   publicKey.Curve.Params().Name,
+			X:       base64.RawURLEncoding.EncodeToString(publicKey.X.FillBytes(make([]byte, size))),
+			Y:       base64.RawURLEncoding.EncodeToString(publicKey.Y.FillBytes(make([]byte, size))),
+		}
+	case ed25519.PublicKey:
+		key = JSONWebKey{
+			KeyType: "OKP",
+			Curve:   "Ed25519",
+			X:       base64.RawURLEncoding.EncodeToString(publicKey),
+		}
+	}
+	key.Use = "sig"
+	key.Algorithm = method.Alg()
+	return key, nil
+}
+
+// PublicKey decodes the key to a *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey
+func (key JSONWebKey) PublicKey() (crypto.PublicKey, error) {
+	switch key.KeyType {
+	case "RSA":
+		modulus, err := decodeBigInt(key.Modulus)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus: %w", err)
+		}
+		exponent, err := decodeBigInt(key.Exponent)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA exponent: %w", err)
+		}
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("RSA exponent out of range")
+		}
+		return &rsa.PublicKey{N: modulus, E: int(exponent.Int64())}, nil
+	case "EC":
+		curve, err := ellipticCurve(key.Curve)
+		if err != nil {
+			return nil, err
+		}
+		x, err := decodeBigInt(key.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC x coordinate: %w", err)
+		}
+		y, err := decodeBigInt(key.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC y coordinate: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("EC point is not on curve %s", key.Curve)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if key.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", key.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", key.KeyType)
+}
+
+// Thumbprint returns the base64url encoded SHA-256 JWK thumbprint of the key (RFC 7638)
+func (key JSONWebKey) Thumbprint() (string, error) {
+	var canonical []byte
+	var err error
+	// members in lexicographic order, as required for the thumbprint
+	switch key.KeyType {
+	case "RSA":
+		canonical, err = json.Marshal(struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{key.Exponent, key.KeyType, key.Modulus})
+	case "EC":
+		canonical, err = json.Marshal(struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{key.Curve, key.KeyType, key.X, key.Y})
+	case "OKP":
+		canonical, err = json.Marshal(struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{key.Curve, key.KeyType, key.X})
+	default:
+		return "", fmt.Errorf("unsupported key type %q", key.KeyType)
+	}
+	if err != nil {
+		return "", err
+	}
+	thumbprint := sha256.Sum256(canonical)
+	return base64.RawURLEncoding.EncodeToString(thumbprint[:]), nil
+}
+
+func ellipticCurve(name string) (elliptic.Curve, error) {
+	switch name {
+	case "P-256":
+		return elliptic.P256(), nil
+	case "P-384":
+		return elliptic.P384(), nil
+	case "P-521":
+		return elliptic.P521(), nil
+	}
+	return nil, fmt.Errorf("unsupported curve %q", name)
+}
+
+func decodeBigInt(encoded string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	return new(big.Int).SetBytes(decoded), nil
+}
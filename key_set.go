@@ -0,0 +1,429 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"os"
+	"time"
+)
+
+// Statuses of the keys of a KeySet
+const (
+	KeyStatusActive  = "active"
+	KeyStatusRetired = "retired"
+)
+
+// KeySet holds the signing keys of a service, as maintained by the rotate command of the CLI. The active key signs
+// tokens, which carry its ID as kid header. Retired keys only verify tokens, for as long as tokens signed before the
+// rotation may be used or refreshed, i.e. the longer of TokenExpiresIn and MaxRenewalTime.
+//
+// HMAC keys sign with HS512, RSA keys with RS256, EC keys with ES256, ES384 or ES512 depending on their curve and
+// Ed25519 keys with EdDSA. Tokens of asymmetric keys can be verified by others with the public keys, see PublicKeys.
+type KeySet struct {
+	Keys []KeySetEntry `json:"keys"`
+}
+
+// KeySetEntry is a key of a KeySet
+type KeySetEntry struct {
+	KeyID string `json:"kid"`
+	// hmac, rsa, ec or ed25519
+	Type      string `json:"type"`
+	Status    string `json:"status"`
+	CreatedAt int64  `json:"createdAt"`
+	// required for retired keys, which verify tokens for a while after it
+	RetiredAt int64 `json:"retiredAt,omitempty"`
+	// HMAC secret, or PEM encoded private key
+	Key string `json:"key"`
+}
+
+// NewKeySetEntry builds an active entry for an *rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey, encoded as
+// PKCS #8 with its JWK thumbprint as key ID
+func NewKeySetEntry(privateKey crypto.Signer) (KeySetEntry, error) {
+	keyType := privateKeyType(privateKey)
+	if keyType == "" {
+		return KeySetEntry{}, fmt.Errorf("unsupported key type %T", privateKey)
+	}
+	encoded, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return KeySetEntry{}, fmt.Errorf("unable to encode private key: %w", err)
+	}
+	publicKey, err := NewJSONWebKey(privateKey.Public())
+	if err != nil {
+		return KeySetEntry{}, err
+	}
+	keyID, err := publicKey.Thumbprint()
+	if err != nil {
+		return KeySetEntry{}, err
+	}
+	return KeySetEntry{
+		KeyID:     keyID,
+		Type:      keyType,
+		Status:    KeyStatusActive,
+		CreatedAt: time.Now().Unix(),
+		Key:       string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: encoded})),
+	}, nil
+}
+
+// ParseKeySet decodes a key set file, checking that key IDs are unique, all keys can be used, retired keys name
+// their retirement and exactly one key is active
+func ParseKeySet(content []byte) (*KeySet, error) {
+	var keys KeySet
+	if err := json.Unmarshal(content, &keys); err != nil {
+		return nil, fmt.Errorf("unable to decode key set: %w", err)
+	}
+
+	active := 0
+	seen := map[string]bool{}
+	for _, entry := range keys.Keys {
+		switch {
+		case entry.KeyID == "":
+			return nil, fmt.Errorf("key set holds a key without kid")
+		case seen[entry.KeyID]:
+			return nil, fmt.Errorf("key set holds key %s twice", entry.KeyID)
+		case entry.Key == "":
+			return nil, fmt.Errorf("key %s must not be empty", entry.KeyID)
+		case entry.Status != KeyStatusActive && entry.Status != KeyStatusRetired:
+			return nil, fmt.Errorf("key %s: unknown status %q", entry.KeyID, entry.Status)
+		case entry.Status == KeyStatusRetired && entry.RetiredAt <= 0:
+			return nil, fmt.Errorf("retired key %s has no retiredAt", entry.KeyID)
+		}
+		if entry.Type != "hmac" {
+			if _, err := entry.privateKey(); err != nil {
+				return nil, fmt.Errorf("key %s: %w", entry.KeyID, err)
+			}
+		}
+		seen[entry.KeyID] = true
+		if entry.Status == KeyStatusActive {
+			active++
+		}
+	}
+	if active != 1 {
+		return nil, fmt.Errorf("key set must hold exactly one active key, got %d", active)
+	}
+	return &keys, nil
+}
+
+// Active returns the active key of the set, or nil if there is none
+func (keys *KeySet) Active() *KeySetEntry {
+	for i := range keys.Keys {
+		if keys.Keys[i].Status == KeyStatusActive {
+			return &keys.Keys[i]
+		}
+	}
+	return nil
+}
+
+// PublicKeys returns the public keys of the asymmetric keys of the set, e.g. to be published as JWKS so that others
+// can verify the tokens. HMAC secrets are left out.
+func (keys *KeySet) PublicKeys() (JSONWebKeySet, error) {
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, entry := range keys.Keys {
+		if entry.Type == "hmac" {
+			continue
+		}
+		privateKey, err := entry.privateKey()
+		if err != nil {
+			return set, fmt.Errorf("key %s: %w", entry.KeyID, err)
+		}
+		publicKey, err := NewJSONWebKey(privateKey.Public())
+		if err != nil {
+			return set, fmt.Errorf("key %s: %w", entry.KeyID, err)
+		}
+		publicKey.KeyID = entry.KeyID
+		set.Keys = append(set.Keys, publicKey)
+	}
+	return set, nil
+}
+
+// ReadKeyFile reads a file holding a plain HMAC secret, a PEM encoded private key or a key set as written by the
+// rotate command of the CLI. It returns the key to sign with, and the key set if the file holds one; a private key
+// is returned as key set of its own. A trailing line break, as left by editors and secret mounts, is ignored.
+func ReadKeyFile(path string) ([]byte, *KeySet, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read key file: %w", err)
+	}
+
+	if block, _ := pem.Decode(content); block != nil {
+		privateKey, err := parsePrivateKey(content)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid key file %s: %w", path, err)
+		}
+		entry, err := NewKeySetEntry(privateKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid key file %s: %w", path, err)
+		}
+		return []byte(entry.Key), &KeySet{Keys: []KeySetEntry{entry}}, nil
+	}
+	if !isKeySet(content) {
+		return bytes.TrimRight(content, "\r\n"), nil, nil
+	}
+
+	keys, err := ParseKeySet(content)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid key set %s: %w", path, err)
+	}
+	return []byte(keys.Active().Key), keys, nil
+}
+
+// --------------------------
+// private stuff
+// --------------------------
+
+// signingMethodEdDSA signs with Ed25519 keys (RFC 8037), which jwt-go does not support
+type signingMethodEdDSA struct{}
+
+func init() {
+	jwt.RegisterSigningMethod("EdDSA", func() jwt.SigningMethod {
+		return signingMethodEdDSA{}
+	})
+}
+
+func (signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+func (signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	decoded, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), decoded) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+// signingMethod returns the method tokens are signed with for a public key, or nil if its type is not supported
+func signingMethod(publicKey crypto.PublicKey) jwt.SigningMethod {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		switch key.Curve.Params().Name {
+		case "P-256":
+			return jwt.SigningMethodES256
+		case "P-384":
+			return jwt.SigningMethodES384
+		case "P-521":
+			return jwt.SigningMethodES512
+		}
+	case ed25519.PublicKey:
+		return signingMethodEdDSA{}
+	}
+	return nil
+}
+
+// privateKeyType returns the KeySetEntry type of a private key, or "" if it is not supported
+func privateKeyType(privateKey crypto.Signer) string {
+	switch privateKey.(type) {
+	case *rsa.PrivateKey:
+		return "rsa"
+	case *ecdsa.PrivateKey:
+		if signingMethod(privateKey.Public()) != nil {
+			return "ec"
+		}
+	case ed25519.PrivateKey:
+		return "ed25519"
+	}
+	return ""
+}
+
+// parsePrivateKey decodes the first PEM block holding a PKCS #8, PKCS #1 or SEC 1 private key
+func parsePrivateKey(content []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		if block, content = pem.Decode(content); block == nil {
+			return nil, errors.New("no PEM encoded private key found")
+		}
+
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode private key: %w", err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok || privateKeyType(signer) == "" {
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+		return signer, nil
+	}
+}
+
+// privateKey decodes the key of an asymmetric entry, checking that it is of the type the entry names
+func (entry KeySetEntry) privateKey() (crypto.Signer, error) {
+	switch entry.Type {
+	case "rsa", "ec", "ed25519":
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", entry.Type)
+	}
+	privateKey, err := parsePrivateKey([]byte(entry.Key))
+	if err != nil {
+		return nil, err
+	}
+	if keyType := privateKeyType(privateKey); keyType != entry.Type {
+		return nil, fmt.Errorf("key of type %s holds a %s key", entry.Type, keyType)
+	}
+	return privateKey, nil
+}
+
+// signingKey returns the method and key to sign tokens with
+func (entry KeySetEntry) signingKey() (jwt.SigningMethod, interface{}, error) {
+	if entry.Type == "hmac" {
+		return jwt.SigningMethodHS512, []byte(entry.Key), nil
+	}
+	privateKey, err := entry.privateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	return signingMethod(privateKey.Public()), privateKey, nil
+}
+
+// verificationKey returns the key to verify a token with, failing if the token is signed with a method not fitting
+// the key, so that e.g. a public key is never taken for an HMAC secret
+func (entry KeySetEntry) verificationKey(token *jwt.Token) (interface{}, error) {
+	if entry.Type == "hmac" {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(entry.Key), nil
+	}
+
+	privateKey, err := entry.privateKey()
+	if err != nil {
+		return nil, err
+	}
+	if token.Method.Alg() != signingMethod(privateKey.Public()).Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return privateKey.Public(), nil
+}
+
+// isKeySet tells whether key material is a key set rather than a plain secret
+func isKeySet(content []byte) bool {
+	var probe struct {
+		Keys json.RawMessage `json:"keys"`
+	}
+	return json.Unmarshal(content, &probe) == nil && probe.Keys != nil
+}
+
+// verificationKeys returns the keys a token may have been signed with: the key named by its kid header, or else the
+// current key followed by the retired HMAC keys still in use. Tokens of asymmetric keys always name their key.
+func (service authService) verificationKeys(keyID string, now time.Time) []KeySetEntry {
+	current := service.signingEntry()
+	keys := service.authConfig.KeySet
+	if keys == nil {
+		return []KeySetEntry{current}
+	}
+
+	if keyID != "" {
+		for _, entry := range keys.Keys {
+			if entry.KeyID == keyID {
+				if !service.usable(entry, now) {
+					return nil
+				}
+				return []KeySetEntry{entry}
+			}
+		}
+	}
+
+	var candidates []KeySetEntry
+	if current.Type == "hmac" {
+		candidates = append(candidates, current)
+	}
+	for _, entry := range keys.Keys {
+		if entry.Status == KeyStatusRetired && entry.Type == "hmac" && service.usable(entry, now) {
+			candidates = append(candidates, entry)
+		}
+	}
+	return candidates
+}
+
+// usable tells whether a key may still verify tokens: retired keys do so as long as tokens signed before their
+// retirement may be used or refreshed, which is never for retired keys without retirement time
+func (service authService) usable(entry KeySetEntry, now time.Time) bool {
+	if entry.Status != KeyStatusRetired {
+		return true
+	}
+	lifetime := service.authConfig.TokenExpiresIn
+	if renewal := int64(service.authConfig.MaxRenewalTime); renewal > lifetime {
+		lifetime = renewal
+	}
+	return entry.RetiredAt > 0 && now.Unix() < entry.RetiredAt+lifetime
+}
+
+// retainKeys adds the keys of this service which are still in use, but missing in a new config, to the key set of
+// the new config as retired keys. A former key thereby keeps verifying the tokens it signed.
+func (service authService) retainKeys(authConfig *Config, now time.Time) {
+	retained := &KeySet{}
+	if authConfig.KeySet != nil {
+		retained.Keys = append(retained.Keys, authConfig.KeySet.Keys...)
+	}
+	known := map[string]bool{string(authConfig.JWTPrivateKey): true}
+	for _, entry := range retained.Keys {
+		known[entry.Key] = true
+	}
+
+	// the current key, then the keys retired before
+	former := []KeySetEntry{service.signingEntry()}
+	if service.authConfig.KeySet != nil {
+		former = append(former, service.authConfig.KeySet.Keys...)
+	}
+	for _, entry := range former {
+		if known[entry.Key] || entry.Key == "" || !service.usable(entry, now) {
+			continue
+		}
+		if entry.Status != KeyStatusRetired {
+			entry.Status, entry.RetiredAt = KeyStatusRetired, now.Unix()
+		}
+		known[entry.Key] = true
+		retained.Keys = append(retained.Keys, entry)
+	}
+
+	if len(retained.Keys) > 0 {
+		authConfig.KeySet = retained
+	}
+}
+
+// signingEntry returns the key tokens are signed with: the active key of the key set if it is the current key, or
+// else the current key as HMAC secret
+func (service authService) signingEntry() KeySetEntry {
+	if service.authConfig.KeySet != nil {
+		active := service.authConfig.KeySet.Active()
+		if active != nil && active.Key == string(service.authConfig.JWTPrivateKey) {
+			return *active
+		}
+	}
+	return KeySetEntry{Type: "hmac", Key: string(service.authConfig.JWTPrivateKey)}
+}
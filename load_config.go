@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LoadConfig builds the Config of a service from DefaultAuthConfig, overridden by the given JSON or YAML files (in
+// order) and then by the AUTH_* environment variables:
+//
+//	AUTH_JWT_PRIVATE_KEY          base64 encoded key
+//	AUTH_JWT_PRIVATE_KEY_FILE     file holding the key or a KeySet
+//	AUTH_ISSUER
+//	AUTH_COOKIE_NAME
+//	AUTH_MFA_COOKIE_NAME
+//	AUTH_FINGERPRINT_COOKIE_NAME
+//	AUTH_EXPIRES_IN               seconds
+//	AUTH_MAX_RENEWAL_TIME         seconds
+//
+// Files use the JSON names of Config, in YAML as well. A key file wins over a key given directly; relative key file
+// paths of config files are resolved against the directory of the file. The result is validated, and all problems
+// found on the way are reported together as *ConfigError.
+func LoadConfig(paths ...string) (Config, error) {
+	config, err := ReadConfig(paths...)
+	var problems []string
+	if err != nil {
+		problems = err.(*ConfigError).Problems
+	}
+	if err, ok := config.Validate().(*ConfigError); ok {
+		problems = append(problems, err.Problems...)
+	}
+	if len(problems) > 0 {
+		return config, &ConfigError{Problems: problems}
+	}
+	return config, nil
+}
+
+// ReadConfig reads the Config like LoadConfig, but without validating it, e.g. to override settings before. Problems
+// reading files or environment variables are reported together as *ConfigError.
+func ReadConfig(paths ...string) (Config, error) {
+	config := DefaultAuthConfig(nil)
+	var problems []string
+
+	for _, path := range paths {
+		keyFile := config.JWTPrivateKeyFile
+		if err := decodeConfigFile(path, &config); err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if config.JWTPrivateKeyFile != keyFile && config.JWTPrivateKeyFile != "" && !filepath.IsAbs(config.JWTPrivateKeyFile) {
+			config.JWTPrivateKeyFile = filepath.Join(filepath.Dir(path), config.JWTPrivateKeyFile)
+		}
+	}
+
+	problems = append(problems, applyEnvironment(&config)...)
+
+	if config.JWTPrivateKeyFile != "" {
+		key, keys, err := ReadKeyFile(config.JWTPrivateKeyFile)
+		if err != nil {
+			problems = append(problems, err.Error())
+		} else {
+			config.JWTPrivateKey, config.KeySet = key, keys
+		}
+	}
+
+	if len(problems) > 0 {
+		return config, &ConfigError{Problems: problems}
+	}
+	return config, nil
+}
+
+// --------------------------
+// private stuff
+// --------------------------
+
+// decodeConfigFile decodes a JSON or YAML file (by extension) onto the config, keeping settings the file lacks
+func decodeConfigFile(path string, config *Config) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		// YAML is converted to JSON, so that both formats use the same names
+		var document interface{}
+		if err := yaml.Unmarshal(content, &document); err != nil {
+			return fmt.Errorf("unable to decode config file %s: %w", path, err)
+		}
+		if document == nil {
+			return nil
+		}
+		if content, err = json.Marshal(document); err != nil {
+			return fmt.Errorf("unable to decode config file %s: %w", path, err)
+		}
+	}
+
+	if err := json.Unmarshal(content, config); err != nil {
+		return fmt.Errorf("unable to decode config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnvironment overrides settings with the AUTH_* environment variables which are set, returning problems with
+// their values
+func applyEnvironment(config *Config) []string {
+	var problems []string
+
+	if key := os.Getenv("AUTH_JWT_PRIVATE_KEY"); key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			problems = append(problems, "AUTH_JWT_PRIVATE_KEY must be base64 encoded")
+		} else {
+			config.JWTPrivateKey = decoded
+		}
+	}
+	if keyFile := os.Getenv("AUTH_JWT_PRIVATE_KEY_FILE"); keyFile != "" {
+		config.JWTPrivateKeyFile = keyFile
+	}
+	if issuer, found := os.LookupEnv("AUTH_ISSUER"); found {
+		config.Issuer = issuer
+	}
+	if cookieName := os.Getenv("AUTH_COOKIE_NAME"); cookieName != "" {
+		config.JWTCookieName = cookieName
+	}
+	if cookieName := os.Getenv("AUTH_MFA_COOKIE_NAME"); cookieName != "" {
+		config.MFACookieName = cookieName
+	}
+	if cookieName, found := os.LookupEnv("AUTH_FINGERPRINT_COOKIE_NAME"); found {
+		config.FingerprintCookieName = cookieName
+	}
+	if expiresIn := os.Getenv("AUTH_EXPIRES_IN"); expiresIn != "" {
+		if seconds, err := strconv.ParseInt(expiresIn, 10, 64); err != nil {
+			problems = append(problems, "AUTH_EXPIRES_IN must be a number of seconds")
+		} else {
+			config.TokenExpiresIn = seconds
+		}
+	}
+	if maxRenewalTime := os.Getenv("AUTH_MAX_RENEWAL_TIME"); maxRenewalTime != "" {
+		if seconds, err := strconv.Atoi(maxRenewalTime); err != nil {
+			problems = append(problems, "AUTH_MAX_RENEWAL_TIME must be a number of seconds")
+		} else {
+			config.MaxRenewalTime = seconds
+		}
+	}
+	return problems
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+    "encoding/base64"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestLoadConfigFromJSONFile(t *testing.T) {
+    path := writeConfigFile(t, "auth.json", `{"jwtPrivateKey": "`+base64.StdEncoding.EncodeToString(validKey)+`", "issuer": "Production", "expiresIn": 60}`)
+
+    config, err := LoadConfig(path)
+
+    if err != nil {
+        t.Fatalf("Config should load, got %s", err)
+    }
+    if string(config.JWTPrivateKey) != string(validKey) || config.Issuer != "Production" || config.TokenExpiresIn != 60 {
+        t.Errorf("Unexpected config %+v", config)
+    }
+    // settings missing in the file keep their defaults
+    if config.JWTCookieName != DefaultAuthConfig(nil).JWTCookieName {
+        t.Errorf("Cookie name should default, got %s", config.JWTCookieName)
+    }
+}
+
+func TestLoadConfigFromYAMLFileWithRelativeKeyFile(t *testing.T) {
+    path := writeConfigFile(t, "auth.yaml", "issuer: Production\ncookieName: SESSION\njwtPrivateKeyFile: jwt.key\n")
+    if err := os.WriteFile(filepath.Join(filepath.Dir(path), "jwt.key"), append(validKey, '\n'), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    config, err := LoadConfig(path)
+
+    if err != nil {
+        t.Fatalf("Config should load, got %s", err)
+    }
+    if string(config.JWTPrivateKey) != string(validKey) || config.Issuer != "Production" || config.JWTCookieName != "SESSION" {
+        t.Errorf("Unexpected config %+v", config)
+    }
+}
+
+func TestLoadConfigEnvironmentOverridesFiles(t *testing.T) {
+    path := writeConfigFile(t, "auth.json", `{"issuer": "Staging", "expiresIn": 60}`)
+    t.Setenv("AUTH_JWT_PRIVATE_KEY", base64.StdEncoding.EncodeToString(validKey))
+    t.Setenv("AUTH_ISSUER", "Production")
+    t.Setenv("AUTH_EXPIRES_IN", "120")
+
+    config, err := LoadConfig(path)
+
+    if err != nil {
+        t.Fatalf("Config should load, got %s", err)
+    }
+    if string(config.JWTPrivateKey) != string(validKey) || config.Issuer != "Production" || config.TokenExpiresIn != 120 {
+        t.Errorf("Unexpected config %+v", config)
+    }
+}
+
+func TestLoadConfigReportsAllProblems(t *testing.T) {
+    t.Setenv("AUTH_JWT_PRIVATE_KEY", "not base64!")
+    t.Setenv("AUTH_MAX_RENEWAL_TIME", "forever")
+
+    _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json"))
+
+    configError, ok := err.(*ConfigError)
+    if !ok {
+        t.Fatalf("Should have returned a config error, got %v", err)
+    }
+    // missing file, key encoding, renewal time, and the key still being empty
+    if len(configError.Problems) != 4 {
+        t.Errorf("Expected 4 problems, got %v", configError.Problems)
+    }
+}
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+    path := filepath.Join(t.TempDir(), name)
+    if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
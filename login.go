@@ -0,0 +1,525 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maximum size of a login request body
+const maxCredentialsSize = 1 << 20
+
+// Credentials as sent to the LoginHandler, either as JSON body or as form values
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// one time password, sent to the second step of the login only
+	Code string `json:"code"`
+}
+
+// TOTPSecrets provides the TOTP secrets of users enrolled for a second factor
+type TOTPSecrets interface {
+	// TOTPSecret returns the base32 encoded secret of the user, or "" if the user has no second factor
+	TOTPSecret(ctx context.Context, authentication *Authentication) (string, error)
+}
+
+// MFARequiredResponse is written by the LoginHandler when the login has to be completed with a second factor
+type MFARequiredResponse struct {
+	MFARequired bool `json:"mfaRequired"`
+}
+
+// lifetime in seconds of the token issued between password and second factor
+const mfaPendingExpiresIn = 5 * 60
+
+// number of wrong codes accepted for one MFA pending token, after which the login has to be started over
+const mfaMaxAttempts = 5
+
+// CredentialVerifier checks the credentials of a user during login
+type CredentialVerifier interface {
+	// VerifyCredentials returns the Authentication of the user owning the credentials. Wrong credentials are
+	// reported with an error matching ErrInvalidCredentials; any other error is treated as an internal failure.
+	// Expiracy, issued at and issuer are stamped by the LoginHandler and need not be set.
+	VerifyCredentials(ctx context.Context, username, password string) (*Authentication, error)
+}
+
+// LoginHandler authenticates users through a CredentialVerifier and sets the JWT cookie on success. The
+// authentication is written as JSON in the response body.
+type LoginHandler struct {
+	service  authService
+	verifier CredentialVerifier
+
+	// optional protection against brute force attacks. Attempts which are not allowed are answered with
+	// 429 Too Many Requests and a Retry-After header.
+	Limiter *LoginLimiter
+
+	// optional second factor. Users having a TOTP secret receive a short lived MFA pending cookie instead of the
+	// JWT cookie, and have to complete the login with a code sent to CompleteMFA.
+	MFA TOTPSecrets
+
+	// attempts per MFA pending token and last accepted TOTP time step per user, kept by this instance
+	mfaGuard mfaGuard
+}
+
+// LoginHandler builds a LoginHandler issuing cookies of this service
+func (service authService) LoginHandler(verifier CredentialVerifier) *LoginHandler {
+	return &LoginHandler{
+		service:  service,
+		verifier: verifier,
+	}
+}
+
+func (handler *LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	service := handler.service.current()
+
+	credentials, err := readCredentials(w, r)
+	if err == nil && (credentials.Username == "" || credentials.Password == "") {
+		err = errors.New("username and password are required")
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad request: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	// clients sending a DPoP proof get a token bound to the proof key
+	var keyThumbprint string
+	if dpop := service.authConfig.DPoP; dpop != nil && r.Header.Get("DPoP") != "" {
+		if keyThumbprint, err = dpop.VerifyProof(r, ""); errors.Is(err, ErrInternal) {
+			service.logger().ErrorContext(r.Context(), "Unable to verify DPoP proof", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Bad request: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var userKey, ipKey string
+	if handler.Limiter != nil {
+		userKey, ipKey = handler.Limiter.keys(r, credentials.Username)
+		wait, err := handler.Limiter.Reserve(r.Context(), userKey, ipKey)
+		if err != nil {
+			service.logger().ErrorContext(r.Context(), "Unable to check login attempts", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if wait > 0 {
+			service.logger().WarnContext(r.Context(), "Login refused",
+				"username_hash", usernameHash(credentials.Username), "reason", ErrTooManyAttempts.Error())
+			w.Header().Set("Retry-After", retryAfter(wait).seconds())
+			http.Error(w, ErrTooManyAttempts.Error(), http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	authentication, err := handler.verifier.VerifyCredentials(r.Context(), credentials.Username, credentials.Password)
+	if err != nil || authentication == nil {
+		if err != nil && !errors.Is(err, ErrInvalidCredentials) {
+			service.logger().ErrorContext(r.Context(), "Unable to verify credentials", "error", err)
+			handler.release(r, service, userKey, ipKey)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		// the reserved attempt remains as failure
+		service.logger().InfoContext(r.Context(), "Login failed",
+			"username_hash", usernameHash(credentials.Username), "reason", ErrInvalidCredentials.Error())
+		http.Error(w, fmt.Sprintf("Unauthorized: %s", ErrInvalidCredentials.Error()), http.StatusUnauthorized)
+		return
+	}
+	if handler.Limiter != nil {
+		if err := handler.Limiter.Success(r.Context(), userKey); err != nil {
+			service.logger().ErrorContext(r.Context(), "Unable to reset login attempts", "error", err)
+		}
+		handler.release(r, service, ipKey)
+	}
+
+	authentication.AuthenticationMethods = []string{AMRPassword}
+	authentication.AuthenticationContextClass = ACRSingleFactor
+	if keyThumbprint != "" {
+		authentication.Confirmation = &Confirmation{KeyThumbprint: keyThumbprint}
+	}
+
+	if handler.MFA != nil {
+		secret, err := handler.MFA.TOTPSecret(r.Context(), authentication)
+		if err != nil {
+			service.logger().ErrorContext(r.Context(), "Unable to look up TOTP secret", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if secret != "" {
+			handler.issueMFAPendingCookie(w, r, service, authentication)
+			return
+		}
+	}
+
+	handler.issueCookie(w, r, service, authentication)
+}
+
+// CompleteMFA returns the handler for the second step of the login. It accepts a TOTP code as JSON or form value
+// "code", together with the MFA pending cookie issued by the first step, and sets the JWT cookie on success. A pending
+// cookie completes a single login; it is refused with ErrRevoked once used, like after 5 wrong codes with
+// ErrTooManyAttempts. Used pending cookies are tracked per instance until they expire.
+func (handler *LoginHandler) CompleteMFA() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if handler.MFA == nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		service := handler.service.current()
+
+		pendingCookie, err := r.Cookie(service.mfaCookieName())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unauthorized: %s", ErrTokenMissing.Error()), http.StatusUnauthorized)
+			return
+		}
+		authentication, err := service.parseToken(pendingCookie.Value, tokenUseMFAPending)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unauthorized: %s", err.Error()), http.StatusUnauthorized)
+			return
+		}
+
+		credentials, err := readCredentials(w, r)
+		if err == nil && credentials.Code == "" {
+			err = errors.New("code is required")
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Bad request: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		// the pending token is used up after a few wrong codes, with or without Limiter
+		pendingID := authentication.ID
+		if pendingID == "" {
+			pendingID = pendingCookie.Value
+		}
+		if err := handler.mfaGuard.reserve(pendingID, time.Unix(authentication.ExpiresAt, 0)); err != nil {
+			service.logger().WarnContext(r.Context(), "Login refused", "subject", authentication.Subject, "reason", err.Error())
+			http.SetCookie(w, service.clearedMFACookie())
+			http.Error(w, fmt.Sprintf("Unauthorized: %s", err.Error()), http.StatusUnauthorized)
+			return
+		}
+
+		var mfaKey string
+		if handler.Limiter != nil {
+			mfaKey = "mfa:" + authentication.Subject
+			wait, err := handler.Limiter.Reserve(r.Context(), mfaKey)
+			if err != nil {
+				service.logger().ErrorContext(r.Context(), "Unable to check MFA attempts", "error", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if wait > 0 {
+				// a throttled code is no attempt of the pending token
+				handler.mfaGuard.release(pendingID)
+				service.logger().WarnContext(r.Context(), "Login refused",
+					"subject", authentication.Subject, "reason", ErrTooManyAttempts.Error())
+				w.Header().Set("Retry-After", retryAfter(wait).seconds())
+				http.Error(w, ErrTooManyAttempts.Error(), http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		secret, err := handler.MFA.TOTPSecret(r.Context(), authentication)
+		if err != nil {
+			service.logger().ErrorContext(r.Context(), "Unable to look up TOTP secret", "error", err)
+			handler.mfaGuard.release(pendingID)
+			handler.release(r, service, mfaKey)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		valid := false
+		if secret != "" {
+			var step int64
+			step, valid, err = verifyTOTPStep(secret, credentials.Code, time.Now())
+			if err != nil {
+				service.logger().ErrorContext(r.Context(), "Unable to verify TOTP code", "error", err)
+				handler.mfaGuard.release(pendingID)
+				handler.release(r, service, mfaKey)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			// a code must not be accepted twice (RFC 6238, section 5.2)
+			valid = valid && handler.mfaGuard.acceptStep(authentication.Subject, step)
+		}
+		// the reserved attempts remain as failures
+		if !valid {
+			service.logger().InfoContext(r.Context(), "Login failed",
+				"subject", authentication.Subject, "reason", ErrInvalidCredentials.Error())
+			http.Error(w, fmt.Sprintf("Unauthorized: %s", ErrInvalidCredentials.Error()), http.StatusUnauthorized)
+			return
+		}
+		if !handler.mfaGuard.consume(pendingID) {
+			err := &Error{ErrorCode: Revoked, Cause: errors.New("MFA pending token already used")}
+			service.logger().WarnContext(r.Context(), "Login refused", "subject", authentication.Subject, "reason", err.Error())
+			http.Error(w, fmt.Sprintf("Unauthorized: %s", err.Error()), http.StatusUnauthorized)
+			return
+		}
+		if handler.Limiter != nil {
+			if err := handler.Limiter.Success(r.Context(), mfaKey); err != nil {
+				service.logger().ErrorContext(r.Context(), "Unable to reset MFA attempts", "error", err)
+			}
+		}
+
+		// the ID belongs to the pending token
+		authentication.ID = ""
+		authentication.AuthenticationMethods = []string{AMRPassword, AMROneTimePassword, AMRMultiFactor}
+		authentication.AuthenticationContextClass = ACRMultiFactor
+
+		http.SetCookie(w, service.clearedMFACookie())
+		handler.issueCookie(w, r, service, authentication)
+	})
+}
+
+// LogoutHandler clears the JWT cookie, and the fingerprint cookie if any
+func (service authService) LogoutHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		service := service.current()
+		http.SetCookie(w, service.GetClearedJWTCookie())
+		if service.authConfig.FingerprintCookieName != "" {
+			cookie := service.fingerprintCookie()
+			cookie.Expires = time.Unix(0, 0)
+			http.SetCookie(w, cookie)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// --------------------------
+// private stuff
+// --------------------------
+
+// release gives back attempts reserved with the Limiter, if any
+func (handler *LoginHandler) release(r *http.Request, service authService, keys ...string) {
+	if handler.Limiter == nil {
+		return
+	}
+	if err := handler.Limiter.Release(r.Context(), keys...); err != nil {
+		service.logger().ErrorContext(r.Context(), "Unable to release login attempt", "error", err)
+	}
+}
+
+// issueCookie stamps a logged in authentication, sets its JWT cookie and writes it as response
+func (handler *LoginHandler) issueCookie(w http.ResponseWriter, r *http.Request, service authService, authentication *Authentication) {
+	service.stampAuthentication(authentication)
+	cookies, err := service.IssueCookies(authentication)
+	if err != nil {
+		service.logger().ErrorContext(r.Context(), "Unable to issue cookie", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	for _, cookie := range cookies {
+		http.SetCookie(w, cookie)
+	}
+	service.logger().InfoContext(r.Context(), "Login succeeded",
+		"subject", authentication.Subject, "amr", strings.Join(authentication.AuthenticationMethods, " "))
+	service.writeJSON(w, r, http.StatusOK, authentication)
+}
+
+// issueMFAPendingCookie sets the short lived cookie which is only accepted by CompleteMFA
+func (handler *LoginHandler) issueMFAPendingCookie(w http.ResponseWriter, r *http.Request, service authService, authentication *Authentication) {
+	service.stampAuthentication(authentication)
+	authentication.ExpiresAt = authentication.IssuedAt + mfaPendingExpiresIn
+	// identifies the pending token when counting its attempts
+	id, err := randomID()
+	if err != nil {
+		service.logger().ErrorContext(r.Context(), "Unable to issue MFA pending cookie", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	authentication.ID = id
+
+	claims := newJWTToken(authentication)
+	claims.TokenUse = tokenUseMFAPending
+	signedString, err := service.signToken(claims)
+	if err != nil {
+		service.logger().ErrorContext(r.Context(), "Unable to issue MFA pending cookie", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     service.mfaCookieName(),
+		Path:     "/",
+		HttpOnly: true,
+		MaxAge:   mfaPendingExpiresIn,
+		Value:    signedString,
+	})
+	service.logger().InfoContext(r.Context(), "Second factor required", "subject", authentication.Subject)
+	service.writeJSON(w, r, http.StatusAccepted, MFARequiredResponse{MFARequired: true})
+}
+
+// mfaGuard counts the codes tried per MFA pending token, remembers the pending tokens used up, and the last accepted
+// TOTP time step per user. Entries are dropped once they can not matter anymore, i.e. when the pending token or the
+// time step expired.
+type mfaGuard struct {
+	mutex     sync.Mutex
+	attempts  map[string]mfaAttempts
+	lastSteps map[string]int64
+}
+
+type mfaAttempts struct {
+	count     int
+	consumed  bool
+	expiresAt time.Time
+}
+
+// reserve counts an attempt for a pending token, or tells why it is not allowed anymore
+func (guard *mfaGuard) reserve(pendingID string, expiresAt time.Time) error {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	guard.sweep()
+	if guard.attempts == nil {
+		guard.attempts = map[string]mfaAttempts{}
+	}
+
+	attempts := guard.attempts[pendingID]
+	if attempts.consumed {
+		return &Error{ErrorCode: Revoked, Cause: errors.New("MFA pending token already used")}
+	}
+	if attempts.count >= mfaMaxAttempts {
+		return ErrTooManyAttempts
+	}
+	guard.attempts[pendingID] = mfaAttempts{count: attempts.count + 1, expiresAt: expiresAt}
+	return nil
+}
+
+// release gives back an attempt which failed for internal reasons
+func (guard *mfaGuard) release(pendingID string) {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	if attempts, found := guard.attempts[pendingID]; found && attempts.count > 0 {
+		attempts.count--
+		guard.attempts[pendingID] = attempts
+	}
+}
+
+// consume marks a pending token used successfully, so that it is refused until it expires. It tells whether a
+// concurrent request used the token first.
+func (guard *mfaGuard) consume(pendingID string) bool {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	attempts, found := guard.attempts[pendingID]
+	if !found || attempts.consumed {
+		return false
+	}
+	attempts.consumed = true
+	guard.attempts[pendingID] = attempts
+	return true
+}
+
+// acceptStep records the time step of a valid code, unless a code of the same or a later step was accepted before
+func (guard *mfaGuard) acceptStep(subject string, step int64) bool {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	if guard.lastSteps == nil {
+		guard.lastSteps = map[string]int64{}
+	}
+
+	if last, found := guard.lastSteps[subject]; found && step <= last {
+		return false
+	}
+	guard.lastSteps[subject] = step
+	return true
+}
+
+func (guard *mfaGuard) sweep() {
+	now := time.Now()
+	for pendingID, attempts := range guard.attempts {
+		if now.After(attempts.expiresAt) {
+			delete(guard.attempts, pendingID)
+		}
+	}
+	// codes of a step are accepted until totpSkew periods after it
+	oldestStep := now.Unix()/totpPeriod - totpSkew
+	for subject, step := range guard.lastSteps {
+		if step < oldestStep {
+			delete(guard.lastSteps, subject)
+		}
+	}
+}
+
+// randomID generates a random token ID
+func randomID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("unable to generate token ID: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func (service authService) mfaCookieName() string {
+	if service.authConfig.MFACookieName != "" {
+		return service.authConfig.MFACookieName
+	}
+	return service.authConfig.JWTCookieName + "_MFA"
+}
+
+func (service authService) clearedMFACookie() *http.Cookie {
+	cookie := service.GetClearedJWTCookie()
+	cookie.Name = service.mfaCookieName()
+	return cookie
+}
+
+// stampAuthentication sets issuer, login time, issued at and expiracy of a freshly logged in authentication
+func (service authService) stampAuthentication(authentication *Authentication) {
+	now := time.Now().In(time.UTC).Unix()
+	authentication.Issuer = service.authConfig.Issuer
+	authentication.AuthTime = now
+	authentication.IssuedAt = now
+	authentication.ExpiresAt = now + service.authConfig.TokenExpiresIn
+}
+
+// usernameHash identifies the username of a failed or refused login in logs without revealing it, as users every now
+// and then type their password into the username field
+func usernameHash(username string) string {
+	hash := sha256.Sum256([]byte(username))
+	return hex.EncodeToString(hash[:8])
+}
+
+// readCredentials reads credentials from a JSON body, or from form values for any other content type
+func readCredentials(w http.ResponseWriter, r *http.Request) (*Credentials, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxCredentialsSize)
+
+	var credentials Credentials
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+			return nil, fmt.Errorf("unable to decode credentials: %w", err)
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return nil, fmt.Errorf("unable to parse form: %w", err)
+		}
+		credentials.Username = r.PostForm.Get("username")
+		credentials.Password = r.PostForm.Get("password")
+		credentials.Code = r.PostForm.Get("code")
+	}
+
+	return &credentials, nil
+}
+
+func (service authService) writeJSON(w http.ResponseWriter, r *http.Request, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		service.logger().ErrorContext(r.Context(), "Unable to write response", "error", err)
+	}
+}
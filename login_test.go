@@ -0,0 +1,167 @@
+package auth
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+    "time"
+)
+
+type staticVerifier map[string]string
+
+func (users staticVerifier) VerifyCredentials(ctx context.Context, username, password string) (*Authentication, error) {
+    if expected, ok := users[username]; !ok || expected != password {
+        return nil, ErrInvalidCredentials
+    }
+    return &Authentication{
+        Subject:     username,
+        Username:    username,
+        Authorities: []GrantedAuthority{{Role: "USER"}},
+    }, nil
+}
+
+type failingVerifier struct{}
+
+func (failingVerifier) VerifyCredentials(ctx context.Context, username, password string) (*Authentication, error) {
+    return nil, errors.New("database down")
+}
+
+func newLoginService() authService {
+    config := DefaultAuthConfig([]byte("privatesigningpassowrd"))
+    return New(config)
+}
+
+func cookieNamed(rr *httptest.ResponseRecorder, name string) *http.Cookie {
+    for _, cookie := range rr.Result().Cookies() {
+        if cookie.Name == name {
+            return cookie
+        }
+    }
+    return nil
+}
+
+func TestLoginWithJSONCredentials(t *testing.T) {
+    service := newLoginService()
+    req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"username":"marty","password":"delorean"}`))
+    req.Header.Set("Content-Type", "application/json")
+    rr := httptest.NewRecorder()
+
+    service.LoginHandler(staticVerifier{"marty": "delorean"}).ServeHTTP(rr, req)
+
+    if rr.Code != http.StatusOK {
+        t.Fatalf("Expected status 200, got %d", rr.Code)
+    }
+    cookie := cookieNamed(rr, "JWT")
+    if cookie == nil {
+        t.Fatal("JWT cookie should have been set")
+    }
+    authentication, err := service.FromCookie(cookie)
+    if err != nil {
+        t.Fatalf("Issued cookie should be valid, got %s", err)
+    }
+    if authentication.Username != "marty" || authentication.Issuer != "AuthServer" ||
+        authentication.ExpiresAt != authentication.IssuedAt+300 {
+        t.Errorf("Authentication has not been stamped correctly: %+v", authentication)
+    }
+}
+
+func TestLoginWithFormCredentials(t *testing.T) {
+    service := newLoginService()
+    form := url.Values{"username": {"marty"}, "password": {"delorean"}}
+    req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    rr := httptest.NewRecorder()
+
+    service.LoginHandler(staticVerifier{"marty": "delorean"}).ServeHTTP(rr, req)
+
+    if rr.Code != http.StatusOK || cookieNamed(rr, "JWT") == nil {
+        t.Errorf("Login with form values should succeed, got status %d", rr.Code)
+    }
+}
+
+func TestLoginWithWrongPassword(t *testing.T) {
+    var logs bytes.Buffer
+    config := DefaultAuthConfig([]byte("privatesigningpassowrd"))
+    config.Logger = slog.New(slog.NewJSONHandler(&logs, nil))
+    service := New(config)
+    req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"username":"marty","password":"biff"}`))
+    req.Header.Set("Content-Type", "application/json")
+    rr := httptest.NewRecorder()
+
+    service.LoginHandler(staticVerifier{"marty": "delorean"}).ServeHTTP(rr, req)
+
+    if rr.Code != http.StatusUnauthorized {
+        t.Errorf("Expected status 401, got %d", rr.Code)
+    }
+    if cookieNamed(rr, "JWT") != nil {
+        t.Error("No cookie should have been set")
+    }
+    // the username may well be a mistyped password
+    if strings.Contains(logs.String(), "marty") || !strings.Contains(logs.String(), usernameHash("marty")) {
+        t.Errorf("Failed login should log a hash of the username only, got %s", logs.String())
+    }
+}
+
+func TestLoginWithFailingVerifier(t *testing.T) {
+    service := newLoginService()
+    req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"username":"marty","password":"delorean"}`))
+    req.Header.Set("Content-Type", "application/json")
+    rr := httptest.NewRecorder()
+
+    service.LoginHandler(failingVerifier{}).ServeHTTP(rr, req)
+
+    if rr.Code != http.StatusInternalServerError {
+        t.Errorf("Expected status 500, got %d", rr.Code)
+    }
+}
+
+func TestLoginRequiresPost(t *testing.T) {
+    service := newLoginService()
+    rr := httptest.NewRecorder()
+
+    service.LoginHandler(staticVerifier{}).ServeHTTP(rr, httptest.NewRequest("GET", "/login", nil))
+
+    if rr.Code != http.StatusMethodNotAllowed {
+        t.Errorf("Expected status 405, got %d", rr.Code)
+    }
+}
+
+func TestLogoutClearsCookie(t *testing.T) {
+    service := newLoginService()
+    rr := httptest.NewRecorder()
+
+    service.LogoutHandler().ServeHTTP(rr, httptest.NewRequest("POST", "/logout", nil))
+
+    cookie := cookieNamed(rr, "JWT")
+    if cookie == nil || cookie.Value != "" || cookie.Expires.After(time.Now()) {
+        t.Errorf("JWT cookie should have been cleared, got %v", cookie)
+    }
+}
+
+func TestLoginAndLogoutWithFingerprintCookie(t *testing.T) {
+    config := DefaultAuthConfig([]byte("privatesigningpassowrd"))
+    config.FingerprintCookieName = "__Secure-Fgp"
+    service := New(config)
+    rr := httptest.NewRecorder()
+    req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"username": "marty", "password": "delorean"}`))
+    req.Header.Set("Content-Type", "application/json")
+
+    service.LoginHandler(staticVerifier{"marty": "delorean"}).ServeHTTP(rr, req)
+
+    if rr.Code != http.StatusOK || cookieNamed(rr, "JWT") == nil || cookieNamed(rr, "__Secure-Fgp") == nil {
+        t.Fatalf("Login should set JWT and fingerprint cookie, got status %d", rr.Code)
+    }
+
+    rr = httptest.NewRecorder()
+    service.LogoutHandler().ServeHTTP(rr, httptest.NewRequest("POST", "/logout", nil))
+
+    if cookie := cookieNamed(rr, "__Secure-Fgp"); cookie == nil || cookie.Value != "" || cookie.Expires.After(time.Now()) {
+        t.Errorf("Fingerprint cookie should have been cleared, got %v", cookie)
+    }
+}
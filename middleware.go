@@ -1,64 +1,68 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
-	"github.com/dgrijalva/jwt-go"
-	"log"
+	"log/slog"
 	"net/http"
+	"time"
 )
 
-func (service authService) IsAuthenticated(next http.Handler) http.Handler {
+// NewMiddleware builds the Middleware for any Authenticator, e.g. an IntrospectionService
+func NewMiddleware(authenticator Authenticator) Middleware {
+	return middleware{authenticator}
+}
+
+// middleware implements Middleware on top of an Authenticator
+type middleware struct {
+	Authenticator
+}
+
+func (m middleware) IsAuthenticated(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if _, err := service.FromRequest(r); err != nil {
-			http.Error(w, fmt.Sprintf("Unauthorized: %s", err.Error()), http.StatusUnauthorized)
+		authentication, err := m.FromRequest(r)
+		if err != nil {
+			// expired tokens still yield their authentication, so that the subject gets logged
+			m.unauthorized(w, r, authentication, err)
 			return
 		}
 
 		// otherwise, JWT check has been successful
-		next.ServeHTTP(w, r)
+		m.authorized(w, r, authentication, next)
 	})
 }
 
 // TODO: add maximum delta check between expiracy and renewal.
-func (service authService) IsAuthenticatedButExpired(next http.Handler) http.Handler {
+func (m middleware) IsAuthenticatedButExpired(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, cookieError := r.Cookie(service.authConfig.JWTCookieName)
-
-		if cookieError != nil {
-			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
-			return
-		}
-
-		_, err := service.FromCookie(cookie)
+		authentication, err := m.FromRequest(r)
 
 		// if we have any errors,
 		if err != nil {
-			if validationError, ok := err.(*jwt.ValidationError); ok {
-				// and if it is only expired, an has no additional errors, then we allow the next function to proceed.
-				if validationError.Errors == jwt.ValidationErrorExpired {
-					log.Println("Expired but valid. Proceeding to next call in chain...")
-					// Call the next handler, which can be another middleware in the chain, or the final handler.
-					next.ServeHTTP(w, r)
-					return
-				}
+			// and if it is only expired, an has no additional errors, then we allow the next function to proceed.
+			if errors.Is(err, ErrTokenExpired) {
+				m.logDecision(r, slog.LevelDebug, "Expired but valid token accepted", authentication, err)
+				// Call the next handler, which can be another middleware in the chain, or the final handler.
+				next.ServeHTTP(w, r)
+				return
 			}
 			// otherwise, set unauthorized
-			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+			m.unauthorized(w, r, authentication, err)
 			return
 		} else {
 			// otherwise, JWT check has been successful
-			next.ServeHTTP(w, r)
+			m.authorized(w, r, authentication, next)
 			return
 		}
 	})
 }
 
-func (service authService) HasAnyRole(role ...string) func(next http.Handler) http.Handler {
+func (m middleware) HasAnyRole(role ...string) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			jwtAuthentication, err := service.FromRequest(r)
+			jwtAuthentication, err := m.FromRequest(r)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("Unauthorized: %s", err.Error()), http.StatusUnauthorized)
+				m.unauthorized(w, r, jwtAuthentication, err)
 				return
 			}
 
@@ -66,14 +70,192 @@ func (service authService) HasAnyRole(role ...string) func(next http.Handler) ht
 				for _, roleToTest := range role {
 					if authority.Role == roleToTest {
 						// yay user has one of the defined roles, proceed to next middleware
-						next.ServeHTTP(w, r)
+						m.authorized(w, r, jwtAuthentication, next)
 						return
 					}
 				}
 			}
 
-			http.Error(w, fmt.Sprintf("Unauthorized: User has none of %s roles", role), http.StatusUnauthorized)
+			m.unauthorized(w, r, jwtAuthentication, fmt.Errorf("User has none of %s roles", role))
+			return
+		})
+	}
+}
+
+func (m middleware) RequireMFA(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwtAuthentication, err := m.FromRequest(r)
+		if err != nil {
+			m.unauthorized(w, r, jwtAuthentication, err)
+			return
+		}
+
+		if !jwtAuthentication.HasAuthenticationMethod(AMRMultiFactor) {
+			m.unauthorized(w, r, jwtAuthentication, ErrMFARequired)
 			return
+		}
+
+		m.authorized(w, r, jwtAuthentication, next)
+	})
+}
+
+func (m middleware) RequireRecentAuth(maxAge time.Duration) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			jwtAuthentication, err := m.FromRequest(r)
+			if err != nil {
+				m.unauthorized(w, r, jwtAuthentication, err)
+				return
+			}
+
+			// tokens without login time are treated as too old
+			loggedInAt := time.Unix(jwtAuthentication.AuthTime, 0)
+			if jwtAuthentication.AuthTime == 0 || time.Since(loggedInAt) > maxAge {
+				m.unauthorized(w, r, jwtAuthentication, ErrRecentAuthRequired)
+				return
+			}
+
+			m.authorized(w, r, jwtAuthentication, next)
 		})
 	}
 }
+
+func (m middleware) IsServiceAccount(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwtAuthentication, err := m.FromRequest(r)
+		if err != nil {
+			m.unauthorized(w, r, jwtAuthentication, err)
+			return
+		}
+
+		if !jwtAuthentication.IsServiceAccount() {
+			m.unauthorized(w, r, jwtAuthentication, errors.New("Not a service account"))
+			return
+		}
+
+		m.authorized(w, r, jwtAuthentication, next)
+	})
+}
+
+func (m middleware) IsUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwtAuthentication, err := m.FromRequest(r)
+		if err != nil {
+			m.unauthorized(w, r, jwtAuthentication, err)
+			return
+		}
+
+		if jwtAuthentication.IsServiceAccount() {
+			m.unauthorized(w, r, jwtAuthentication, errors.New("Service accounts are not allowed"))
+			return
+		}
+
+		m.authorized(w, r, jwtAuthentication, next)
+	})
+}
+
+// authorized logs the granted request and hands it over to the next handler
+func (m middleware) authorized(w http.ResponseWriter, r *http.Request, authentication *Authentication, next http.Handler) {
+	m.logDecision(r, slog.LevelDebug, "Request authorized", authentication, nil)
+	next.ServeHTTP(w, r)
+}
+
+// unauthorized logs the denied request and answers with 401, challenging the client to authenticate if the
+// Authenticator is a Challenger. Throttled clients get 429 with a Retry-After header instead. Credentials which
+// could not be checked at all (ErrInternal) are answered with 500, without telling the client why.
+func (m middleware) unauthorized(w http.ResponseWriter, r *http.Request, authentication *Authentication, reason error) {
+	if errors.Is(reason, ErrInternal) {
+		loggerOf(m.Authenticator).ErrorContext(r.Context(), "Unable to authenticate request",
+			"method", r.Method, "route", r.URL.Path, "error", reason)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	m.logDecision(r, decisionLevel(reason), "Request unauthorized", authentication, reason)
+	var wait retryAfter
+	if errors.As(reason, &wait) {
+		w.Header().Set("Retry-After", wait.seconds())
+		http.Error(w, reason.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if challenger, ok := m.Authenticator.(Challenger); ok {
+		if challenge := challenger.Challenge(); challenge != "" {
+			w.Header().Set("WWW-Authenticate", challenge)
+		}
+	}
+	http.Error(w, fmt.Sprintf("Unauthorized: %s", reason.Error()), http.StatusUnauthorized)
+}
+
+// logDecision logs an auth decision with the subject, the reason and the route of the request. Tokens are never
+// logged; neither are the errors of this package carrying them.
+func (m middleware) logDecision(r *http.Request, level slog.Level, message string, authentication *Authentication, reason error) {
+	logger := loggerOf(m.Authenticator)
+	if !logger.Enabled(r.Context(), level) {
+		return
+	}
+
+	attrs := []slog.Attr{slog.String("method", r.Method), slog.String("route", r.URL.Path)}
+	if authentication != nil {
+		attrs = append(attrs, slog.String("subject", authentication.Subject))
+		if authentication.ClientID != "" {
+			attrs = append(attrs, slog.String("client_id", authentication.ClientID))
+		}
+	}
+	if reason != nil {
+		attrs = append(attrs, slog.String("reason", reason.Error()))
+	}
+	logger.LogAttrs(r.Context(), level, message, attrs...)
+}
+
+// decisionLevel logs the usual comings and goings of clients at debug level, and requests with forged, tampered or
+// stolen credentials at warn level
+func decisionLevel(reason error) slog.Level {
+	switch {
+	case errors.Is(reason, ErrTokenMissing), errors.Is(reason, ErrTokenExpired):
+		return slog.LevelDebug
+	case errors.Is(reason, ErrSignatureInvalid), errors.Is(reason, ErrTokenMalformed), errors.Is(reason, ErrRevoked),
+		errors.Is(reason, ErrBindingMismatch), errors.Is(reason, ErrDPoPProofInvalid),
+		errors.Is(reason, ErrTooManyAttempts):
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
+
+// loggerOf returns the logger configured for the Authenticator, if it has any
+func loggerOf(authenticator Authenticator) *slog.Logger {
+	if logged, ok := authenticator.(interface{ logger() *slog.Logger }); ok {
+		return logged.logger()
+	}
+	return slog.Default()
+}
+
+// --------------------------
+// authService middleware
+// --------------------------
+
+func (service authService) IsAuthenticated(next http.Handler) http.Handler {
+	return middleware{service}.IsAuthenticated(next)
+}
+
+func (service authService) IsAuthenticatedButExpired(next http.Handler) http.Handler {
+	return middleware{service}.IsAuthenticatedButExpired(next)
+}
+
+func (service authService) HasAnyRole(role ...string) func(next http.Handler) http.Handler {
+	return middleware{service}.HasAnyRole(role...)
+}
+
+func (service authService) RequireMFA(next http.Handler) http.Handler {
+	return middleware{service}.RequireMFA(next)
+}
+
+func (service authService) RequireRecentAuth(maxAge time.Duration) func(next http.Handler) http.Handler {
+	return middleware{service}.RequireRecentAuth(maxAge)
+}
+
+func (service authService) IsServiceAccount(next http.Handler) http.Handler {
+	return middleware{service}.IsServiceAccount(next)
+}
+
+func (service authService) IsUser(next http.Handler) http.Handler {
+	return middleware{service}.IsUser(next)
+}
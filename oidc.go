@@ -0,0 +1,449 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCConfig configures the login through an OpenID Connect provider, using the authorization code flow with PKCE
+type OIDCConfig struct {
+	// issuer of the provider; its discovery document is read from <IssuerURL>/.well-known/openid-configuration
+	IssuerURL    string `json:"issuerUrl"`
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret,omitempty"`
+	// URL of the CallbackHandler, as registered at the provider
+	RedirectURL string `json:"redirectUrl"`
+	// requested scopes. Defaults to openid, profile and email.
+	Scopes []string `json:"scopes,omitempty"`
+	// where to send the user after a successful login. Defaults to "/".
+	PostLoginRedirect string `json:"postLoginRedirect,omitempty"`
+	// maps the claims of a verified ID token to an Authentication. Defaults to DefaultOIDCClaimMapper.
+	ClaimMapper func(claims map[string]interface{}) (*Authentication, error) `json:"-"`
+	// client used to talk to the provider. Defaults to a client with a 10 seconds timeout.
+	HTTPClient *http.Client `json:"-"`
+}
+
+// OIDCProvider logs users in through an OpenID Connect provider and issues the JWT cookie of the service for them
+type OIDCProvider struct {
+	service   authService
+	config    OIDCConfig
+	discovery oidcDiscovery
+
+	mutex         sync.RWMutex
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+const (
+	// lifetime in seconds of the state, nonce and verifier cookies
+	oidcFlowExpiresIn = 10 * 60
+	// minimum time between two fetches of the provider keys
+	oidcKeysRefreshInterval = time.Minute
+)
+
+// NewOIDCProvider reads the discovery document and keys of the provider
+func (service authService) NewOIDCProvider(ctx context.Context, config OIDCConfig) (*OIDCProvider, error) {
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email"}
+	}
+	if config.PostLoginRedirect == "" {
+		config.PostLoginRedirect = "/"
+	}
+	if config.ClaimMapper == nil {
+		config.ClaimMapper = DefaultOIDCClaimMapper
+	}
+
+	provider := &OIDCProvider{
+		service: service,
+		config:  config,
+	}
+
+	discoveryURL := strings.TrimSuffix(config.IssuerURL, "/") + "/.well-known/openid-configuration"
+	if err := provider.getJSON(ctx, discoveryURL, &provider.discovery); err != nil {
+		return nil, fmt.Errorf("unable to read discovery document: %w", err)
+	}
+	if provider.discovery.Issuer != config.IssuerURL {
+		return nil, fmt.Errorf("discovery document is issued by %q, expected %q", provider.discovery.Issuer, config.IssuerURL)
+	}
+	if err := provider.fetchKeys(ctx); err != nil {
+		return nil, err
+	}
+
+	return provider, nil
+}
+
+// LoginHandler redirects the user to the provider, remembering state, nonce and PKCE verifier in cookies
+func (provider *OIDCProvider) LoginHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state, stateError := randomString()
+		nonce, nonceError := randomString()
+		verifier, verifierError := randomString()
+		if err := firstError(stateError, nonceError, verifierError); err != nil {
+			provider.service.logger().ErrorContext(r.Context(), "Unable to start OIDC login", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		authorizationURL, err := url.Parse(provider.discovery.AuthorizationEndpoint)
+		if err != nil {
+			provider.service.logger().ErrorContext(r.Context(), "Invalid OIDC authorization endpoint", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		challenge := sha256.Sum256([]byte(verifier))
+		query := authorizationURL.Query()
+		query.Set("response_type", "code")
+		query.Set("client_id", provider.config.ClientID)
+		query.Set("redirect_uri", provider.config.RedirectURL)
+		query.Set("scope", strings.Join(provider.config.Scopes, " "))
+		query.Set("state", state)
+		query.Set("nonce", nonce)
+		query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+		query.Set("code_challenge_method", "S256")
+		authorizationURL.RawQuery = query.Encode()
+
+		http.SetCookie(w, provider.flowCookie("STATE", state, oidcFlowExpiresIn))
+		http.SetCookie(w, provider.flowCookie("NONCE", nonce, oidcFlowExpiresIn))
+		http.SetCookie(w, provider.flowCookie("VERIFIER", verifier, oidcFlowExpiresIn))
+		http.Redirect(w, r, authorizationURL.String(), http.StatusFound)
+	})
+}
+
+// CallbackHandler completes the login: it exchanges the authorization code, verifies the ID token, maps its claims
+// to an Authentication and sets the JWT cookie of the service
+func (provider *OIDCProvider) CallbackHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if providerError := query.Get("error"); providerError != "" {
+			http.Error(w, fmt.Sprintf("Unauthorized: identity provider returned %s", providerError), http.StatusUnauthorized)
+			return
+		}
+
+		state := provider.flowCookieValue(r, "STATE")
+		nonce := provider.flowCookieValue(r, "NONCE")
+		verifier := provider.flowCookieValue(r, "VERIFIER")
+		if state == "" || nonce == "" || verifier == "" || !constantTimeEquals(state, query.Get("state")) {
+			http.Error(w, "Bad request: state mismatch", http.StatusBadRequest)
+			return
+		}
+
+		idToken, err := provider.exchangeCode(r.Context(), query.Get("code"), verifier)
+		if err != nil {
+			provider.service.logger().ErrorContext(r.Context(), "Unable to exchange OIDC authorization code", "error", err)
+			http.Error(w, "Unauthorized: unable to exchange authorization code", http.StatusUnauthorized)
+			return
+		}
+		claims, err := provider.verifyIDToken(r.Context(), idToken, nonce)
+		if err != nil {
+			provider.service.logger().WarnContext(r.Context(), "Login failed",
+				"issuer", provider.discovery.Issuer, "reason", err.Error())
+			http.Error(w, fmt.Sprintf("Unauthorized: %s", err.Error()), http.StatusUnauthorized)
+			return
+		}
+		authentication, err := provider.config.ClaimMapper(claims)
+		if err != nil {
+			provider.service.logger().InfoContext(r.Context(), "Login failed",
+				"issuer", provider.discovery.Issuer, "reason", err.Error())
+			http.Error(w, fmt.Sprintf("Unauthorized: %s", err.Error()), http.StatusUnauthorized)
+			return
+		}
+
+		service := provider.service.current()
+		service.stampAuthentication(authentication)
+		// the login happened at the provider
+		if authTime := int64(toFloat64(claims["auth_time"])); authTime > 0 {
+			authentication.AuthTime = authTime
+		}
+		cookies, err := service.IssueCookies(authentication)
+		if err != nil {
+			service.logger().ErrorContext(r.Context(), "Unable to issue cookie", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		for _, name := range []string{"STATE", "NONCE", "VERIFIER"} {
+			http.SetCookie(w, provider.flowCookie(name, "", -1))
+		}
+		for _, cookie := range cookies {
+			http.SetCookie(w, cookie)
+		}
+		service.logger().InfoContext(r.Context(), "Login succeeded",
+			"subject", authentication.Subject, "issuer", provider.discovery.Issuer)
+		http.Redirect(w, r, provider.config.PostLoginRedirect, http.StatusFound)
+	})
+}
+
+// DefaultOIDCClaimMapper maps the standard OIDC claims: sub, name, preferred_username (falling back to email) and
+// amr. Roles are read from the "roles" claim, or from "groups" if there are none.
+func DefaultOIDCClaimMapper(claims map[string]interface{}) (*Authentication, error) {
+	subject := toString(claims["sub"])
+	if subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+
+	username := toString(claims["preferred_username"])
+	if username == "" {
+		username = toString(claims["email"])
+	}
+
+	roles := toStrings(claims["roles"])
+	if len(roles) == 0 {
+		roles = toStrings(claims["groups"])
+	}
+	var authorities []GrantedAuthority
+	for _, role := range roles {
+		authorities = append(authorities, GrantedAuthority{Role: role})
+	}
+
+	return &Authentication{
+		Subject:               subject,
+		Name:                  toString(claims["name"]),
+		Username:              username,
+		Authorities:           authorities,
+		AuthenticationMethods: toStrings(claims["amr"]),
+	}, nil
+}
+
+// --------------------------
+// private stuff
+// --------------------------
+
+// exchangeCode redeems an authorization code at the token endpoint and returns the ID token
+func (provider *OIDCProvider) exchangeCode(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", provider.config.RedirectURL)
+	form.Set("code_verifier", verifier)
+	if provider.config.ClientSecret == "" {
+		form.Set("client_id", provider.config.ClientID)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if provider.config.ClientSecret != "" {
+		// client_secret_basic requires both to be form encoded (RFC 6749, section 2.3.1)
+		request.SetBasicAuth(url.QueryEscape(provider.config.ClientID), url.QueryEscape(provider.config.ClientSecret))
+	}
+
+	response, err := provider.config.HTTPClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %d: %s", response.StatusCode, body)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return "", fmt.Errorf("unable to decode token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return tokens.IDToken, nil
+}
+
+// verifyIDToken checks signature, issuer, audience, expiracy and nonce of an ID token
+func (provider *OIDCProvider) verifyIDToken(ctx context.Context, idToken, nonce string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA, *jwt.SigningMethodRSAPSS:
+		default:
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return provider.publicKey(ctx, kid)
+	})
+	if token == nil || !token.Valid {
+		return nil, fromValidationError(err)
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, &Error{ErrorCode: TokenMalformed, Cause: errors.New("ID token has no expiracy")}
+	}
+	if issuer := toString(claims["iss"]); issuer != provider.discovery.Issuer {
+		return nil, &Error{
+			ErrorCode: IssuerMismatch,
+			Cause:     fmt.Errorf("expected %q, got %q", provider.discovery.Issuer, issuer),
+		}
+	}
+	audiences := toAudiences(claims["aud"])
+	if !containsString(audiences, provider.config.ClientID) ||
+		(len(audiences) > 1 && toString(claims["azp"]) != provider.config.ClientID) {
+		return nil, &Error{
+			ErrorCode: AudienceMismatch,
+			Cause:     fmt.Errorf("%q is not an audience of %v", provider.config.ClientID, audiences),
+		}
+	}
+	if !constantTimeEquals(toString(claims["nonce"]), nonce) {
+		return nil, &Error{ErrorCode: TokenMalformed, Cause: errors.New("nonce mismatch")}
+	}
+
+	return claims, nil
+}
+
+// publicKey looks up a key of the provider, fetching the keys again if it is unknown, e.g. after a rotation
+func (provider *OIDCProvider) publicKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	if key := provider.cachedKey(kid); key != nil {
+		return key, nil
+	}
+
+	provider.mutex.RLock()
+	recentlyFetched := time.Since(provider.keysFetchedAt) < oidcKeysRefreshInterval
+	provider.mutex.RUnlock()
+	if !recentlyFetched {
+		if err := provider.fetchKeys(ctx); err != nil {
+			return nil, err
+		}
+		if key := provider.cachedKey(kid); key != nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+func (provider *OIDCProvider) cachedKey(kid string) crypto.PublicKey {
+	provider.mutex.RLock()
+	defer provider.mutex.RUnlock()
+	if kid == "" && len(provider.keys) == 1 {
+		for _, key := range provider.keys {
+			return key
+		}
+	}
+	return provider.keys[kid]
+}
+
+func (provider *OIDCProvider) fetchKeys(ctx context.Context) error {
+	var keySet JSONWebKeySet
+	if err := provider.getJSON(ctx, provider.discovery.JWKSURI, &keySet); err != nil {
+		return fmt.Errorf("unable to read provider keys: %w", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jsonWebKey := range keySet.Keys {
+		if jsonWebKey.Use != "" && jsonWebKey.Use != "sig" {
+			continue
+		}
+		key, err := jsonWebKey.PublicKey()
+		if err != nil {
+			// keys of unsupported types are skipped
+			continue
+		}
+		keys[jsonWebKey.KeyID] = key
+	}
+
+	provider.mutex.Lock()
+	provider.keys = keys
+	provider.keysFetchedAt = time.Now()
+	provider.mutex.Unlock()
+	return nil
+}
+
+func (provider *OIDCProvider) getJSON(ctx context.Context, url string, target interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+
+	response, err := provider.config.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", url, response.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(target)
+}
+
+// flowCookie builds one of the cookies holding the state of a running login. They have to be sent along with the
+// top level redirect back from the provider, hence SameSite lax.
+func (provider *OIDCProvider) flowCookie(name, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     provider.service.current().authConfig.JWTCookieName + "_OIDC_" + name,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(provider.config.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   maxAge,
+		Value:    value,
+	}
+}
+
+func (provider *OIDCProvider) flowCookieValue(r *http.Request, name string) string {
+	cookie, err := r.Cookie(provider.service.current().authConfig.JWTCookieName + "_OIDC_" + name)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// randomString returns 32 random bytes, base64url encoded
+func randomString() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+func constantTimeEquals(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
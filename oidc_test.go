@@ -0,0 +1,196 @@
+package auth
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "github.com/dgrijalva/jwt-go"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "sync"
+    "testing"
+    "time"
+)
+
+// stubIdP is a minimal OpenID Connect provider issuing ID tokens for codes registered by the test
+type stubIdP struct {
+    server *httptest.Server
+    key    *rsa.PrivateKey
+
+    mutex sync.Mutex
+    // pending authorization requests by code
+    codes map[string]url.Values
+    // extra claims put into each ID token
+    claims jwt.MapClaims
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    idp := &stubIdP{key: key, codes: map[string]url.Values{}}
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+        _ = json.NewEncoder(w).Encode(map[string]string{
+            "issuer":                 idp.server.URL,
+            "authorization_endpoint": idp.server.URL + "/authorize",
+            "token_endpoint":         idp.server.URL + "/token",
+            "jwks_uri":               idp.server.URL + "/jwks",
+        })
+    })
+    mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+        _ = json.NewEncoder(w).Encode(JSONWebKeySet{Keys: []JSONWebKey{{
+            KeyType:  "RSA",
+            KeyID:    "stub-key",
+            Use:      "sig",
+            Modulus:  base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+            Exponent: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+        }}})
+    })
+    mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+        clientID, clientSecret, _ := r.BasicAuth()
+        idp.mutex.Lock()
+        authorization, found := idp.codes[r.PostFormValue("code")]
+        delete(idp.codes, r.PostFormValue("code"))
+        idp.mutex.Unlock()
+
+        challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+        if !found || clientID != "delorean" || clientSecret != "secret" ||
+            authorization.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+            http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+            return
+        }
+
+        _ = json.NewEncoder(w).Encode(map[string]string{
+            "access_token": "opaque",
+            "token_type":   "Bearer",
+            "id_token":     idp.idToken(t, authorization.Get("nonce")),
+        })
+    })
+    idp.server = httptest.NewServer(mux)
+    return idp
+}
+
+func (idp *stubIdP) idToken(t *testing.T, nonce string) string {
+    claims := jwt.MapClaims{
+        "iss":   idp.server.URL,
+        "aud":   "delorean",
+        "sub":   "marty",
+        "exp":   time.Now().Add(time.Minute).Unix(),
+        "iat":   time.Now().Unix(),
+        "nonce": nonce,
+    }
+    for name, value := range idp.claims {
+        claims[name] = value
+    }
+    token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+    token.Header["kid"] = "stub-key"
+    signed, err := token.SignedString(idp.key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return signed
+}
+
+// authorize plays the part of the user logging in at the provider, returning the callback request
+func (idp *stubIdP) authorize(t *testing.T, login *httptest.ResponseRecorder) *http.Request {
+    location, err := url.Parse(login.Header().Get("Location"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    query := location.Query()
+    idp.mutex.Lock()
+    idp.codes["code-1"] = query
+    idp.mutex.Unlock()
+
+    callback := httptest.NewRequest("GET", "/callback?code=code-1&state="+url.QueryEscape(query.Get("state")), nil)
+    for _, cookie := range login.Result().Cookies() {
+        callback.AddCookie(cookie)
+    }
+    return callback
+}
+
+func newTestOIDCProvider(t *testing.T, idp *stubIdP) (authService, *OIDCProvider) {
+    service := newLoginService()
+    provider, err := service.NewOIDCProvider(context.Background(), OIDCConfig{
+        IssuerURL:    idp.server.URL,
+        ClientID:     "delorean",
+        ClientSecret: "secret",
+        RedirectURL:  "http://localhost/callback",
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    return service, provider
+}
+
+func TestOIDCLogin(t *testing.T) {
+    idp := newStubIdP(t)
+    defer idp.server.Close()
+    idp.claims = jwt.MapClaims{"name": "Marty McFly", "preferred_username": "marty", "groups": []string{"ADMIN"}}
+    service, provider := newTestOIDCProvider(t, idp)
+
+    login := httptest.NewRecorder()
+    provider.LoginHandler().ServeHTTP(login, httptest.NewRequest("GET", "/login", nil))
+    if login.Code != http.StatusFound {
+        t.Fatalf("Expected redirect to provider, got %d", login.Code)
+    }
+
+    callback := httptest.NewRecorder()
+    provider.CallbackHandler().ServeHTTP(callback, idp.authorize(t, login))
+
+    if callback.Code != http.StatusFound || callback.Header().Get("Location") != "/" {
+        t.Fatalf("Expected redirect after login, got %d: %s", callback.Code, callback.Body.String())
+    }
+    authentication, err := service.FromCookie(cookieNamed(callback, "JWT"))
+    if err != nil {
+        t.Fatalf("Issued cookie should be valid, got %s", err)
+    }
+    if authentication.Subject != "marty" || authentication.Name != "Marty McFly" ||
+        authentication.Issuer != "AuthServer" || len(authentication.Authorities) != 1 ||
+        authentication.Authorities[0].Role != "ADMIN" {
+        t.Errorf("Unexpected authentication %+v", authentication)
+    }
+}
+
+func TestOIDCCallbackRejectsStateMismatch(t *testing.T) {
+    idp := newStubIdP(t)
+    defer idp.server.Close()
+    _, provider := newTestOIDCProvider(t, idp)
+
+    login := httptest.NewRecorder()
+    provider.LoginHandler().ServeHTTP(login, httptest.NewRequest("GET", "/login", nil))
+    callbackRequest := idp.authorize(t, login)
+    callbackRequest.URL.RawQuery = "code=code-1&state=forged"
+
+    callback := httptest.NewRecorder()
+    provider.CallbackHandler().ServeHTTP(callback, callbackRequest)
+
+    if callback.Code != http.StatusBadRequest || cookieNamed(callback, "JWT") != nil {
+        t.Errorf("Forged state should be rejected, got %d", callback.Code)
+    }
+}
+
+func TestOIDCCallbackRejectsWrongAudience(t *testing.T) {
+    idp := newStubIdP(t)
+    defer idp.server.Close()
+    idp.claims = jwt.MapClaims{"aud": "someone-else"}
+    _, provider := newTestOIDCProvider(t, idp)
+
+    login := httptest.NewRecorder()
+    provider.LoginHandler().ServeHTTP(login, httptest.NewRequest("GET", "/login", nil))
+
+    callback := httptest.NewRecorder()
+    provider.CallbackHandler().ServeHTTP(callback, idp.authorize(t, login))
+
+    if callback.Code != http.StatusUnauthorized || cookieNamed(callback, "JWT") != nil {
+        t.Errorf("ID token for another audience should be rejected, got %d", callback.Code)
+    }
+}
@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// PasswordHasher hashes passwords into self describing strings, which embed algorithm and parameters
+type PasswordHasher interface {
+	// Hash hashes a password with a fresh salt
+	Hash(password string) (string, error)
+
+	// Verify compares a password against a hash created by any hasher of this package. needsRehash is set for
+	// matching passwords whose hash was created with another algorithm or other parameters than the ones of
+	// this hasher, so that it can be replaced on login.
+	Verify(password, encoded string) (ok bool, needsRehash bool, err error)
+}
+
+// ErrUnsupportedHash is returned when verifying against a hash of an unknown format
+var ErrUnsupportedHash = errors.New("unsupported password hash format")
+
+// VerifyPassword compares a password against a hash created by any hasher of this package, in constant time
+func VerifyPassword(password, encoded string) (bool, error) {
+	switch {
+	case strings.HasPrefix(encoded, argon2idPrefix):
+		params, salt, hash, err := decodeArgon2id(encoded)
+		if err != nil {
+			return false, err
+		}
+		computed := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(hash)))
+		return subtle.ConstantTimeCompare(computed, hash) == 1, nil
+	case isBcrypt(encoded):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	return false, ErrUnsupportedHash
+}
+
+// --------------------------
+// bcrypt
+// --------------------------
+
+// BcryptHasher hashes passwords with bcrypt. Passwords longer than 72 bytes are rejected by bcrypt.
+type BcryptHasher struct {
+	Cost int
+}
+
+// DefaultBcryptHasher uses bcrypt.DefaultCost
+func DefaultBcryptHasher() BcryptHasher {
+	return BcryptHasher{Cost: bcrypt.DefaultCost}
+}
+
+func (hasher BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), hasher.Cost)
+	return string(hash), err
+}
+
+func (hasher BcryptHasher) Verify(password, encoded string) (bool, bool, error) {
+	ok, err := VerifyPassword(password, encoded)
+	if !ok || err != nil {
+		return false, false, err
+	}
+	cost, costError := bcrypt.Cost([]byte(encoded))
+	return true, costError != nil || cost != hasher.Cost, nil
+}
+
+func isBcrypt(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// --------------------------
+// argon2id
+// --------------------------
+
+const argon2idPrefix = "$argon2id$"
+
+// Argon2idHasher hashes passwords with argon2id, encoded in the PHC string format:
+// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>
+type Argon2idHasher struct {
+	// number of passes over the memory
+	Time uint32
+	// memory in KiB
+	Memory uint32
+	// degree of parallelism
+	Threads uint8
+	// length of the derived key in bytes
+	KeyLength uint32
+	// length of the random salt in bytes
+	SaltLength uint32
+}
+
+// DefaultArgon2idHasher uses the parameters recommended by OWASP: 19 MiB of memory, 2 passes, 1 thread
+func DefaultArgon2idHasher() Argon2idHasher {
+	return Argon2idHasher{
+		Time:       2,
+		Memory:     19 * 1024,
+		Threads:    1,
+		KeyLength:  32,
+		SaltLength: 16,
+	}
+}
+
+func (hasher Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, hasher.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("unable to generate salt: %w", err)
+	}
+
+	hash := argon2.IDKey([]byte(password), salt, hasher.Time, hasher.Memory, hasher.Threads, hasher.KeyLength)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, hasher.Memory, hasher.Time, hasher.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+func (hasher Argon2idHasher) Verify(password, encoded string) (bool, bool, error) {
+	ok, err := VerifyPassword(password, encoded)
+	if !ok || err != nil {
+		return false, false, err
+	}
+	params, salt, hash, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true, true, nil
+	}
+	needsRehash := params.Time != hasher.Time || params.Memory != hasher.Memory || params.Threads != hasher.Threads ||
+		uint32(len(hash)) != hasher.KeyLength || uint32(len(salt)) != hasher.SaltLength
+	return true, needsRehash, nil
+}
+
+// decodeArgon2id parses a hash in the PHC string format
+func decodeArgon2id(encoded string) (Argon2idHasher, []byte, []byte, error) {
+	var params Argon2idHasher
+
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, hash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, ErrUnsupportedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("%w: argon2 version %s", ErrUnsupportedHash, parts[2])
+	}
+	// argon2 panics on zero passes or threads
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil || params.Time == 0 || params.Threads == 0 {
+		return params, nil, nil, fmt.Errorf("%w: argon2 parameters %s", ErrUnsupportedHash, parts[3])
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("%w: argon2 salt", ErrUnsupportedHash)
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(hash) == 0 {
+		return params, nil, nil, fmt.Errorf("%w: argon2 hash", ErrUnsupportedHash)
+	}
+	params.KeyLength = uint32(len(hash))
+	params.SaltLength = uint32(len(salt))
+
+	return params, salt, hash, nil
+}
@@ -0,0 +1,163 @@
+package auth
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// cheap parameters, so that tests run fast
+var testArgon2idHasher = Argon2idHasher{Time: 1, Memory: 64, Threads: 1, KeyLength: 16, SaltLength: 8}
+
+func TestArgon2idHashAndVerify(t *testing.T) {
+    hash, err := testArgon2idHasher.Hash("delorean")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+        t.Errorf("Unexpected hash encoding %s", hash)
+    }
+
+    if ok, needsRehash, err := testArgon2idHasher.Verify("delorean", hash); !ok || needsRehash || err != nil {
+        t.Errorf("Password should match without rehash, got %v %v %v", ok, needsRehash, err)
+    }
+    if ok, _, _ := testArgon2idHasher.Verify("hoverboard", hash); ok {
+        t.Error("Wrong password should not match")
+    }
+}
+
+func TestArgon2idNeedsRehashWhenParametersChange(t *testing.T) {
+    hash, _ := testArgon2idHasher.Hash("delorean")
+    stronger := testArgon2idHasher
+    stronger.Time = 2
+
+    if ok, needsRehash, _ := stronger.Verify("delorean", hash); !ok || !needsRehash {
+        t.Errorf("Hash with outdated parameters should match and need a rehash")
+    }
+}
+
+func TestBcryptHashCanBeVerifiedByArgon2idHasher(t *testing.T) {
+    bcryptHasher := BcryptHasher{Cost: 4}
+    hash, err := bcryptHasher.Hash("delorean")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if ok, needsRehash, _ := bcryptHasher.Verify("delorean", hash); !ok || needsRehash {
+        t.Error("Password should match without rehash")
+    }
+    if ok, needsRehash, _ := testArgon2idHasher.Verify("delorean", hash); !ok || !needsRehash {
+        t.Error("bcrypt hash should match and need a rehash to argon2id")
+    }
+}
+
+func TestVerifyUnsupportedHash(t *testing.T) {
+    cases := map[string]string{
+        "plain":        "plain",
+        "zero passes":  "$argon2id$v=19$m=19456,t=0,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaA",
+        "zero threads": "$argon2id$v=19$m=19456,t=2,p=0$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaA",
+    }
+
+    for name, encoded := range cases {
+        if _, err := VerifyPassword("delorean", encoded); !errors.Is(err, ErrUnsupportedHash) {
+            t.Errorf("%s: expected unsupported hash error, got %v", name, err)
+        }
+    }
+}
+
+func TestInMemoryUsersRehashOnLogin(t *testing.T) {
+    oldHash, _ := BcryptHasher{Cost: 4}.Hash("delorean")
+    users := NewInMemoryUsers(testArgon2idHasher)
+    users.AddHashed("marty", oldHash, Authentication{Username: "marty"})
+
+    authentication, err := users.VerifyCredentials(context.Background(), "marty", "delorean")
+
+    if err != nil || authentication.Username != "marty" {
+        t.Fatalf("Login should succeed, got %v", err)
+    }
+    if newHash := users.Users()[0].PasswordHash; !strings.HasPrefix(newHash, argon2idPrefix) {
+        t.Errorf("Password should have been rehashed with argon2id, got %s", newHash)
+    }
+}
+
+func TestInMemoryUsersRejectsWrongCredentials(t *testing.T) {
+    users := NewInMemoryUsers(testArgon2idHasher)
+    _ = users.Add("marty", "delorean", Authentication{Username: "marty"})
+
+    if _, err := users.VerifyCredentials(context.Background(), "marty", "biff"); !errors.Is(err, ErrInvalidCredentials) {
+        t.Errorf("Wrong password should be rejected, got %v", err)
+    }
+    if _, err := users.VerifyCredentials(context.Background(), "biff", "delorean"); !errors.Is(err, ErrInvalidCredentials) {
+        t.Errorf("Unknown user should be rejected, got %v", err)
+    }
+}
+
+func TestFileUsersPersistRehashedPasswords(t *testing.T) {
+    oldHash, _ := BcryptHasher{Cost: 4}.Hash("delorean")
+    path := filepath.Join(t.TempDir(), "users.json")
+    content := `[{"username":"marty","passwordHash":"` + oldHash + `","authentication":{"username":"marty"}}]`
+    if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    users, err := NewFileUsers(path, testArgon2idHasher)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := users.VerifyCredentials(context.Background(), "marty", "delorean"); err != nil {
+        t.Fatalf("Login should succeed, got %v", err)
+    }
+
+    reloaded, err := NewFileUsers(path, testArgon2idHasher)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if hash := reloaded.Users()[0].PasswordHash; !strings.HasPrefix(hash, argon2idPrefix) {
+        t.Errorf("Rehashed password should have been written back, got %s", hash)
+    }
+}
+
+func TestConcurrentRehashesAreAllStored(t *testing.T) {
+    oldHash, _ := BcryptHasher{Cost: 4}.Hash("delorean")
+    users := NewInMemoryUsers(testArgon2idHasher)
+    for i := 0; i < 20; i++ {
+        users.AddHashed(fmt.Sprintf("user%d", i), oldHash, Authentication{})
+    }
+    var stored []StoredUser
+    var calls int32
+    var mutex sync.Mutex
+    users.onRehash = func(list []StoredUser) error {
+        mutex.Lock()
+        calls++
+        // earlier lists take longer to store
+        delay := time.Duration(20-calls) * time.Millisecond
+        mutex.Unlock()
+        time.Sleep(delay)
+        mutex.Lock()
+        defer mutex.Unlock()
+        stored = list
+        return nil
+    }
+
+    var wg sync.WaitGroup
+    for i := 0; i < 20; i++ {
+        wg.Add(1)
+        go func(username string) {
+            defer wg.Done()
+            _, _ = users.VerifyCredentials(context.Background(), username, "delorean")
+        }(fmt.Sprintf("user%d", i))
+    }
+    wg.Wait()
+
+    for _, user := range stored {
+        if !strings.HasPrefix(user.PasswordHash, argon2idPrefix) {
+            t.Errorf("Rehashed password of %s should have been stored, got %s", user.Username, user.PasswordHash)
+        }
+    }
+}
@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AttemptState holds the failed attempts registered for a key, e.g. a username or a client IP. Attempts still being
+// verified count as failed until they are released.
+type AttemptState struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastFailure"`
+}
+
+// RateLimitStore persists AttemptStates. Implementations may be shared between instances, e.g. backed by redis.
+type RateLimitStore interface {
+	// Get returns the state of a key, or the zero state if it is unknown
+	Get(ctx context.Context, key string) (AttemptState, error)
+	// Increment atomically adds delta to the failures of a key, never going below zero, and returns the state as it
+	// was before. A positive delta records now as last failure. The key may be forgotten after ttl.
+	Increment(ctx context.Context, key string, delta int, now time.Time, ttl time.Duration) (AttemptState, error)
+	// Delete forgets a key
+	Delete(ctx context.Context, key string) error
+}
+
+// LoginLimiter slows down brute force attacks on the login. Each failed attempt is registered for the username and
+// the client IP; after FreeAttempts failures, further attempts are delayed with exponential backoff, and after
+// LockoutThreshold failures the key is locked out for LockoutDuration.
+//
+// Attempts are reserved before the credentials are verified, so that parallel guesses are counted as well: a
+// reserved attempt counts as failed unless it is released or the key is reset on success.
+type LoginLimiter struct {
+	Store RateLimitStore
+	// failures allowed before attempts get delayed
+	FreeAttempts int
+	// delay after the first failure exceeding FreeAttempts, doubled with every further failure
+	BaseDelay time.Duration
+	// upper bound of the backoff delay
+	MaxDelay time.Duration
+	// failures after which the key is locked out
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// failures are forgotten after this time without failure
+	ResetAfter time.Duration
+	// extracts the client IP of a request. Defaults to the host of RemoteAddr; override when running behind a
+	// trusted proxy.
+	ClientIP func(r *http.Request) string
+
+	now func() time.Time
+}
+
+// NewLoginLimiter creates a LoginLimiter with defaults: 3 free attempts, backoff from 1 second up to 15 minutes,
+// lockout for 30 minutes after 10 failures, failures forgotten after one hour
+func NewLoginLimiter(store RateLimitStore) *LoginLimiter {
+	return &LoginLimiter{
+		Store:            store,
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         15 * time.Minute,
+		LockoutThreshold: 10,
+		LockoutDuration:  30 * time.Minute,
+		ResetAfter:       time.Hour,
+		ClientIP:         remoteAddrIP,
+		now:              time.Now,
+	}
+}
+
+// Allow tells how long to wait before an attempt is allowed for all keys; zero if it is allowed right away. Allow
+// does not count the attempt; use Reserve before verifying credentials.
+func (limiter *LoginLimiter) Allow(ctx context.Context, keys ...string) (time.Duration, error) {
+	now := limiter.currentTime()
+	var retryAfter time.Duration
+	for _, key := range keys {
+		state, err := limiter.Store.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if wait := limiter.wait(state, now); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	return retryAfter, nil
+}
+
+// Reserve counts an attempt for all keys before it is verified, and tells how long to wait before it would have been
+// allowed; zero if it is allowed right away. Attempts which are not allowed are not counted, so that they neither
+// extend a delay nor a lockout. Allowed attempts which succeed are given back with Success or Release.
+func (limiter *LoginLimiter) Reserve(ctx context.Context, keys ...string) (time.Duration, error) {
+	if wait, err := limiter.Allow(ctx, keys...); err != nil || wait > 0 {
+		return wait, err
+	}
+
+	now := limiter.currentTime()
+	var retryAfter time.Duration
+	for _, key := range keys {
+		previous, err := limiter.Store.Increment(ctx, key, 1, now, limiter.ttl())
+		if err != nil {
+			return 0, err
+		}
+		if wait := limiter.wait(previous, now); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		// concurrent attempts reserved the allowed ones in the meantime
+		return retryAfter, limiter.Release(ctx, keys...)
+	}
+	return 0, nil
+}
+
+// Release gives back a reserved attempt for keys which are not reset on success, e.g. the client IP, or when an
+// attempt could not be verified at all
+func (limiter *LoginLimiter) Release(ctx context.Context, keys ...string) error {
+	now := limiter.currentTime()
+	for _, key := range keys {
+		if _, err := limiter.Store.Increment(ctx, key, -1, now, limiter.ttl()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Failure registers a failed attempt for all keys which has not been reserved
+func (limiter *LoginLimiter) Failure(ctx context.Context, keys ...string) error {
+	now := limiter.currentTime()
+	for _, key := range keys {
+		if _, err := limiter.Store.Increment(ctx, key, 1, now, limiter.ttl()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Success forgets the failures of the given keys. Only the username should be reset, otherwise an attacker owning
+// an account could reset the counter of its IP.
+func (limiter *LoginLimiter) Success(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		if err := limiter.Store.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// --------------------------
+// private stuff
+// --------------------------
+
+// wait computes how long a key is still blocked by its failures
+func (limiter *LoginLimiter) wait(state AttemptState, now time.Time) time.Duration {
+	if state.Failures == 0 {
+		return 0
+	}
+	return state.LastFailure.Add(limiter.delay(state.Failures)).Sub(now)
+}
+
+// ttl is how long failures need to be remembered, including the longest possible block
+func (limiter *LoginLimiter) ttl() time.Duration {
+	ttl := limiter.ResetAfter
+	for _, blocked := range []time.Duration{limiter.MaxDelay, limiter.LockoutDuration} {
+		if blocked > ttl {
+			ttl = blocked
+		}
+	}
+	return ttl
+}
+
+// delay computes how long a key is blocked after the given number of failures
+func (limiter *LoginLimiter) delay(failures int) time.Duration {
+	if limiter.LockoutThreshold > 0 && failures >= limiter.LockoutThreshold {
+		return limiter.LockoutDuration
+	}
+	if failures <= limiter.FreeAttempts {
+		return 0
+	}
+	delay := limiter.BaseDelay
+	for i := limiter.FreeAttempts + 1; i < failures; i++ {
+		delay *= 2
+		if delay >= limiter.MaxDelay {
+			return limiter.MaxDelay
+		}
+	}
+	return delay
+}
+
+func (limiter *LoginLimiter) currentTime() time.Time {
+	if limiter.now == nil {
+		return time.Now()
+	}
+	return limiter.now()
+}
+
+// keys returns the username and client IP keys of a login attempt
+func (limiter *LoginLimiter) keys(r *http.Request, username string) (string, string) {
+	clientIP := limiter.ClientIP
+	if clientIP == nil {
+		clientIP = remoteAddrIP
+	}
+	return "user:" + username, "ip:" + clientIP(r)
+}
+
+// retryAfter is the cause of the ErrTooManyAttempts errors of authenticators, telling clients when to try again
+type retryAfter time.Duration
+
+func (wait retryAfter) Error() string {
+	return "retry after " + wait.seconds() + "s"
+}
+
+// seconds rounds the wait up to whole seconds, as sent in a Retry-After header
+func (wait retryAfter) seconds() string {
+	return strconv.FormatInt(int64(math.Ceil(time.Duration(wait).Seconds())), 10)
+}
+
+func remoteAddrIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// --------------------------
+// in memory store
+// --------------------------
+
+// InMemoryRateLimitStore is a RateLimitStore for a single instance
+type InMemoryRateLimitStore struct {
+	mutex     sync.Mutex
+	entries   map[string]rateLimitEntry
+	lastSweep time.Time
+}
+
+type rateLimitEntry struct {
+	state     AttemptState
+	expiresAt time.Time
+}
+
+// NewInMemoryRateLimitStore creates an empty InMemoryRateLimitStore
+func NewInMemoryRateLimitStore() *InMemoryRateLimitStore {
+	return &InMemoryRateLimitStore{
+		entries: map[string]rateLimitEntry{},
+	}
+}
+
+func (store *InMemoryRateLimitStore) Get(ctx context.Context, key string) (AttemptState, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	entry, found := store.entries[key]
+	if !found || time.Now().After(entry.expiresAt) {
+		return AttemptState{}, nil
+	}
+	return entry.state, nil
+}
+
+func (store *InMemoryRateLimitStore) Increment(ctx context.Context, key string, delta int, now time.Time, ttl time.Duration) (AttemptState, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	var previous AttemptState
+	if entry, found := store.entries[key]; found && time.Now().Before(entry.expiresAt) {
+		previous = entry.state
+	}
+
+	state := previous
+	state.Failures += delta
+	if state.Failures < 0 {
+		state.Failures = 0
+	}
+	if delta > 0 {
+		state.LastFailure = now
+	}
+	store.entries[key] = rateLimitEntry{state: state, expiresAt: time.Now().Add(ttl)}
+
+	// drop expired entries once in a while, so that the map does not grow forever
+	if now := time.Now(); now.Sub(store.lastSweep) > time.Minute {
+		for entryKey, entry := range store.entries {
+			if now.After(entry.expiresAt) {
+				delete(store.entries, entryKey)
+			}
+		}
+		store.lastSweep = now
+	}
+	return previous, nil
+}
+
+func (store *InMemoryRateLimitStore) Delete(ctx context.Context, key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.entries, key)
+	return nil
+}
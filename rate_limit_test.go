@@ -0,0 +1,121 @@
+package auth
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestLoginLimiterBackoffAndLockout(t *testing.T) {
+    now := time.Unix(issuedAt, 0)
+    limiter := NewLoginLimiter(NewInMemoryRateLimitStore())
+    limiter.now = func() time.Time { return now }
+    ctx := context.Background()
+
+    expectedDelays := []time.Duration{0, 0, 0, time.Second, 2 * time.Second, 4 * time.Second}
+    for i, expected := range expectedDelays {
+        _ = limiter.Failure(ctx, "user:marty")
+        if retryAfter, _ := limiter.Allow(ctx, "user:marty"); retryAfter != expected {
+            t.Errorf("After %d failures expected delay %s, got %s", i+1, expected, retryAfter)
+        }
+    }
+
+    for i := len(expectedDelays); i < limiter.LockoutThreshold; i++ {
+        _ = limiter.Failure(ctx, "user:marty")
+    }
+    if retryAfter, _ := limiter.Allow(ctx, "user:marty"); retryAfter != limiter.LockoutDuration {
+        t.Errorf("Expected lockout of %s, got %s", limiter.LockoutDuration, retryAfter)
+    }
+
+    _ = limiter.Success(ctx, "user:marty")
+    if retryAfter, _ := limiter.Allow(ctx, "user:marty"); retryAfter != 0 {
+        t.Errorf("Success should reset the failures, got delay %s", retryAfter)
+    }
+}
+
+func TestLoginHandlerAnswersTooManyRequests(t *testing.T) {
+    service := newLoginService()
+    handler := service.LoginHandler(staticVerifier{"marty": "delorean"})
+    handler.Limiter = NewLoginLimiter(NewInMemoryRateLimitStore())
+    handler.Limiter.FreeAttempts = 1
+    handler.Limiter.BaseDelay = time.Minute
+
+    login := func(password string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"username":"marty","password":"`+password+`"}`))
+        req.Header.Set("Content-Type", "application/json")
+        rr := httptest.NewRecorder()
+        handler.ServeHTTP(rr, req)
+        return rr
+    }
+
+    login("biff")
+    login("biff")
+    rr := login("delorean")
+
+    if rr.Code != http.StatusTooManyRequests {
+        t.Fatalf("Expected status 429, got %d", rr.Code)
+    }
+    if rr.Header().Get("Retry-After") != "60" {
+        t.Errorf("Expected Retry-After of 60 seconds, got %s", rr.Header().Get("Retry-After"))
+    }
+}
+
+// countingVerifier counts the attempts reaching it, taking its time like a password hash does
+type countingVerifier struct {
+    attempts int32
+}
+
+func (verifier *countingVerifier) VerifyCredentials(ctx context.Context, username, password string) (*Authentication, error) {
+    atomic.AddInt32(&verifier.attempts, 1)
+    time.Sleep(10 * time.Millisecond)
+    return nil, ErrInvalidCredentials
+}
+
+func TestLoginLimiterCountsParallelAttempts(t *testing.T) {
+    service := newLoginService()
+    verifier := &countingVerifier{}
+    handler := service.LoginHandler(verifier)
+    handler.Limiter = NewLoginLimiter(NewInMemoryRateLimitStore())
+
+    var wg sync.WaitGroup
+    for i := 0; i < 200; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"username":"marty","password":"biff"}`))
+            req.Header.Set("Content-Type", "application/json")
+            handler.ServeHTTP(httptest.NewRecorder(), req)
+        }()
+    }
+    wg.Wait()
+
+    // the free attempts, and the one allowed right after them
+    if attempts := atomic.LoadInt32(&verifier.attempts); attempts != int32(handler.Limiter.FreeAttempts+1) {
+        t.Errorf("Expected %d attempts to reach the verifier, got %d", handler.Limiter.FreeAttempts+1, attempts)
+    }
+    // refused attempts are not counted, they would extend the delay forever
+    if state, _ := handler.Limiter.Store.Get(context.Background(), "user:marty"); state.Failures != int(atomic.LoadInt32(&verifier.attempts)) {
+        t.Errorf("Only attempts reaching the verifier should have been counted, got %d", state.Failures)
+    }
+}
+
+func TestSuccessfulLoginReleasesAttemptOfIP(t *testing.T) {
+    service := newLoginService()
+    handler := service.LoginHandler(staticVerifier{"marty": "delorean"})
+    handler.Limiter = NewLoginLimiter(NewInMemoryRateLimitStore())
+
+    for i := 0; i < 10; i++ {
+        req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"username":"marty","password":"delorean"}`))
+        req.Header.Set("Content-Type", "application/json")
+        rr := httptest.NewRecorder()
+        handler.ServeHTTP(rr, req)
+        if rr.Code != http.StatusOK {
+            t.Fatalf("Login %d should succeed, got %d", i+1, rr.Code)
+        }
+    }
+}
@@ -0,0 +1,250 @@
+package auth
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+// "12345678901234567890" from the test vectors of RFC 6238
+const rfcTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeMatchesRFCTestVectors(t *testing.T) {
+    vectors := map[int64]string{
+        59:         "287082",
+        1111111109: "081804",
+        1234567890: "005924",
+        2000000000: "279037",
+    }
+    for at, expected := range vectors {
+        code, err := TOTPCode(rfcTOTPSecret, time.Unix(at, 0))
+        if err != nil || code != expected {
+            t.Errorf("At %d expected %s, got %s (%v)", at, expected, code, err)
+        }
+    }
+}
+
+func TestVerifyTOTPAcceptsAdjacentPeriods(t *testing.T) {
+    now := time.Unix(1111111109, 0)
+    previous, _ := TOTPCode(rfcTOTPSecret, now.Add(-30*time.Second))
+    tooOld, _ := TOTPCode(rfcTOTPSecret, now.Add(-90*time.Second))
+
+    if ok, _ := VerifyTOTP(rfcTOTPSecret, previous, now); !ok {
+        t.Error("Code of the previous period should be accepted")
+    }
+    if ok, _ := VerifyTOTP(rfcTOTPSecret, tooOld, now); ok {
+        t.Error("Code of three periods ago should be rejected")
+    }
+}
+
+func TestGeneratedSecretInURI(t *testing.T) {
+    secret, err := GenerateTOTPSecret()
+    if err != nil || len(secret) != 32 {
+        t.Fatalf("Expected a 32 character secret, got %q (%v)", secret, err)
+    }
+
+    uri := TOTPURI("Hill Valley", "marty@hillvalley.com", secret)
+
+    if !strings.HasPrefix(uri, "otpauth://totp/Hill%20Valley:marty@hillvalley.com?") ||
+        !strings.Contains(uri, "secret="+secret) {
+        t.Errorf("Unexpected URI %s", uri)
+    }
+}
+
+type staticTOTPSecrets map[string]string
+
+func (secrets staticTOTPSecrets) TOTPSecret(ctx context.Context, authentication *Authentication) (string, error) {
+    return secrets[authentication.Username], nil
+}
+
+func TestLoginWithSecondFactor(t *testing.T) {
+    service := newLoginService()
+    handler := service.LoginHandler(staticVerifier{"marty": "delorean"})
+    handler.MFA = staticTOTPSecrets{"marty": rfcTOTPSecret}
+
+    // first step: password
+    req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"username":"marty","password":"delorean"}`))
+    req.Header.Set("Content-Type", "application/json")
+    rr := httptest.NewRecorder()
+    handler.ServeHTTP(rr, req)
+
+    if rr.Code != http.StatusAccepted || cookieNamed(rr, "JWT") != nil {
+        t.Fatalf("Expected status 202 without JWT cookie, got %d", rr.Code)
+    }
+    pendingCookie := cookieNamed(rr, "JWT_MFA")
+    if pendingCookie == nil {
+        t.Fatal("MFA pending cookie should have been set")
+    }
+    if _, err := service.FromCookie(&http.Cookie{Value: pendingCookie.Value}); !errors.Is(err, ErrMFARequired) {
+        t.Errorf("MFA pending token should not be accepted as regular token, got %v", err)
+    }
+
+    // second step: wrong code, then the right one
+    completeMFA := func(code string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest("POST", "/login/mfa", strings.NewReader(`{"code":"`+code+`"}`))
+        req.Header.Set("Content-Type", "application/json")
+        req.AddCookie(pendingCookie)
+        rr := httptest.NewRecorder()
+        handler.CompleteMFA().ServeHTTP(rr, req)
+        return rr
+    }
+
+    if rr := completeMFA("000000"); rr.Code != http.StatusUnauthorized {
+        t.Errorf("Wrong code should be rejected, got %d", rr.Code)
+    }
+
+    code, _ := TOTPCode(rfcTOTPSecret, time.Now())
+    rr = completeMFA(code)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("Expected status 200, got %d", rr.Code)
+    }
+    authentication, err := service.FromCookie(cookieNamed(rr, "JWT"))
+    if err != nil {
+        t.Fatalf("Issued cookie should be valid, got %s", err)
+    }
+    if !authentication.HasAuthenticationMethod(AMRMultiFactor) || authentication.AuthenticationContextClass != ACRMultiFactor {
+        t.Errorf("Authentication should record the second factor, got %+v", authentication)
+    }
+}
+
+func TestMFAPendingTokenAttemptsAreCapped(t *testing.T) {
+    service := newLoginService()
+    handler := service.LoginHandler(staticVerifier{"marty": "delorean"})
+    handler.MFA = staticTOTPSecrets{"marty": rfcTOTPSecret}
+    pendingCookie := startMFALogin(t, handler)
+
+    for i := 0; i < mfaMaxAttempts; i++ {
+        if rr := completeMFALogin(handler, pendingCookie, "000000"); rr.Code != http.StatusUnauthorized {
+            t.Fatalf("Wrong code should be rejected, got %d", rr.Code)
+        }
+    }
+
+    // even the right code is refused once the pending token is used up
+    code, _ := TOTPCode(rfcTOTPSecret, time.Now())
+    rr := completeMFALogin(handler, pendingCookie, code)
+    if rr.Code != http.StatusUnauthorized || cookieNamed(rr, "JWT") != nil {
+        t.Errorf("Pending token should be used up after %d wrong codes, got %d", mfaMaxAttempts, rr.Code)
+    }
+
+    // a new login gets a new pending token
+    if rr := completeMFALogin(handler, startMFALogin(t, handler), code); rr.Code != http.StatusOK {
+        t.Errorf("Expected status 200 with a new pending token, got %d", rr.Code)
+    }
+}
+
+func TestTOTPCodeCanNotBeReplayed(t *testing.T) {
+    service := newLoginService()
+    handler := service.LoginHandler(staticVerifier{"marty": "delorean"})
+    handler.MFA = staticTOTPSecrets{"marty": rfcTOTPSecret}
+
+    code, _ := TOTPCode(rfcTOTPSecret, time.Now())
+    if rr := completeMFALogin(handler, startMFALogin(t, handler), code); rr.Code != http.StatusOK {
+        t.Fatalf("Expected status 200, got %d", rr.Code)
+    }
+    if rr := completeMFALogin(handler, startMFALogin(t, handler), code); rr.Code != http.StatusUnauthorized {
+        t.Errorf("Accepted code should not be accepted again, got %d", rr.Code)
+    }
+
+    // nor a code of an earlier period
+    previous, _ := TOTPCode(rfcTOTPSecret, time.Now().Add(-totpPeriod*time.Second))
+    if rr := completeMFALogin(handler, startMFALogin(t, handler), previous); rr.Code != http.StatusUnauthorized {
+        t.Errorf("Code of an earlier period should be rejected, got %d", rr.Code)
+    }
+}
+
+func TestMFAPendingTokenCanNotBeReplayed(t *testing.T) {
+    service := newLoginService()
+    handler := service.LoginHandler(staticVerifier{"marty": "delorean"})
+    handler.MFA = staticTOTPSecrets{"marty": rfcTOTPSecret}
+    pendingCookie := startMFALogin(t, handler)
+
+    code, _ := TOTPCode(rfcTOTPSecret, time.Now())
+    if rr := completeMFALogin(handler, pendingCookie, code); rr.Code != http.StatusOK {
+        t.Fatalf("Expected status 200, got %d", rr.Code)
+    }
+
+    // a code of the next period is accepted in general, but not with a used pending token
+    next, _ := TOTPCode(rfcTOTPSecret, time.Now().Add(totpPeriod*time.Second))
+    rr := completeMFALogin(handler, pendingCookie, next)
+    if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), ErrRevoked.Error()) {
+        t.Errorf("Used pending token should be refused, got %d (%s)", rr.Code, rr.Body.String())
+    }
+}
+
+func TestThrottledCodesDoNotUseUpPendingToken(t *testing.T) {
+    service := newLoginService()
+    handler := service.LoginHandler(staticVerifier{"marty": "delorean"})
+    handler.MFA = staticTOTPSecrets{"marty": rfcTOTPSecret}
+    handler.Limiter = NewLoginLimiter(NewInMemoryRateLimitStore())
+    now := time.Now()
+    handler.Limiter.now = func() time.Time { return now }
+    pendingCookie := startMFALogin(t, handler)
+
+    for i := 0; i <= handler.Limiter.FreeAttempts; i++ {
+        handler.Limiter.Failure(context.Background(), "mfa:marty")
+    }
+    for i := 0; i < mfaMaxAttempts; i++ {
+        if rr := completeMFALogin(handler, pendingCookie, "000000"); rr.Code != http.StatusTooManyRequests {
+            t.Fatalf("Code should be throttled, got %d", rr.Code)
+        }
+    }
+
+    now = now.Add(time.Minute)
+    code, _ := TOTPCode(rfcTOTPSecret, time.Now())
+    if rr := completeMFALogin(handler, pendingCookie, code); rr.Code != http.StatusOK {
+        t.Errorf("Pending token should still be usable once the delay is over, got %d", rr.Code)
+    }
+}
+
+// startMFALogin logs in with password, returning the MFA pending cookie
+func startMFALogin(t *testing.T, handler *LoginHandler) *http.Cookie {
+    req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"username":"marty","password":"delorean"}`))
+    req.Header.Set("Content-Type", "application/json")
+    rr := httptest.NewRecorder()
+    handler.ServeHTTP(rr, req)
+
+    pendingCookie := cookieNamed(rr, "JWT_MFA")
+    if rr.Code != http.StatusAccepted || pendingCookie == nil {
+        t.Fatalf("Expected status 202 with MFA pending cookie, got %d", rr.Code)
+    }
+    return pendingCookie
+}
+
+func completeMFALogin(handler *LoginHandler, pendingCookie *http.Cookie, code string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest("POST", "/login/mfa", strings.NewReader(`{"code":"`+code+`"}`))
+    req.Header.Set("Content-Type", "application/json")
+    req.AddCookie(pendingCookie)
+    rr := httptest.NewRecorder()
+    handler.CompleteMFA().ServeHTTP(rr, req)
+    return rr
+}
+
+func TestRequireMFAMiddleware(t *testing.T) {
+    service := newLoginService()
+    singleFactor := service.ToJWTCookie(&Authentication{
+        ExpiresAt:             expires2099,
+        Issuer:                "AuthServer",
+        AuthenticationMethods: []string{AMRPassword},
+    })
+    multiFactor := service.ToJWTCookie(&Authentication{
+        ExpiresAt:             expires2099,
+        Issuer:                "AuthServer",
+        AuthenticationMethods: []string{AMRPassword, AMROneTimePassword, AMRMultiFactor},
+    })
+
+    for cookie, expectedVisit := range map[*http.Cookie]bool{singleFactor: false, multiFactor: true} {
+        nextHandler := &nextHandler{}
+        req, rr := newRequestResponseEmulation(t)
+        req.AddCookie(cookie)
+
+        service.RequireMFA(nextHandler).ServeHTTP(rr, req)
+
+        if nextHandler.Visited != expectedVisit {
+            t.Errorf("Expected next handler visited to be %v", expectedVisit)
+        }
+    }
+}
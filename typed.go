@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// TypedAuthentication is an Authentication accompanied by custom claims of type C
+type TypedAuthentication[C any] struct {
+	Authentication
+	// custom claims. Their fields are signed as top level claims using their json names, so they also show up in
+	// Authentication.Extra when parsed. Fields named after a reserved claim are ignored.
+	Claims C
+}
+
+// TypedService signs and parses a user defined claims struct C next to the Authentication. Cookie handling and
+// middleware are the ones of the underlying authService and behave identically.
+type TypedService[C any] struct {
+	authService
+}
+
+// NewTyped builds a TypedService instance given the config object
+func NewTyped[C any](authConfig Config) TypedService[C] {
+	return TypedService[C]{
+		New(authConfig),
+	}
+}
+
+// FromRequest from http.Request transforms a cookie in a request in a TypedAuthentication instance
+func (service TypedService[C]) FromRequest(r *http.Request) (*TypedAuthentication[C], error) {
+	return service.toTyped(service.authService.FromRequest(r))
+}
+
+// FromCookie transforms a JWT cookie back to a TypedAuthentication. Just like authService.FromCookie, an expired
+// but otherwise valid token yields both the authentication and the validation error.
+func (service TypedService[C]) FromCookie(cookie *http.Cookie) (*TypedAuthentication[C], error) {
+	return service.toTyped(service.authService.FromCookie(cookie))
+}
+
+// ToJWTCookie transforms a TypedAuthentication into a Cookie. If the custom claims can not be encoded, a cleared
+// cookie is returned.
+func (service TypedService[C]) ToJWTCookie(authentication *TypedAuthentication[C]) *http.Cookie {
+	untyped, err := toUntyped(authentication)
+	if err != nil {
+		return service.GetClearedJWTCookie()
+	}
+	return service.authService.ToJWTCookie(untyped)
+}
+
+// IssueCookie transforms a TypedAuthentication into a Cookie, failing if the custom claims can not be encoded or
+// the token can not be signed
+func (service TypedService[C]) IssueCookie(authentication *TypedAuthentication[C]) (*http.Cookie, error) {
+	untyped, err := toUntyped(authentication)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode custom claims: %w", err)
+	}
+	return service.authService.IssueCookie(untyped)
+}
+
+// RefreshAuthentication refreshes TypedAuthentication expiracy date, keeping its custom claims
+func (service TypedService[C]) RefreshAuthentication(oldAuth *TypedAuthentication[C]) (*TypedAuthentication[C], error) {
+	refreshed, err := service.authService.RefreshAuthentication(&oldAuth.Authentication)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedAuthentication[C]{
+		Authentication: *refreshed,
+		Claims:         oldAuth.Claims,
+	}, nil
+}
+
+// --------------------------
+// private stuff
+// --------------------------
+
+// toTyped decodes the extra claims of an authentication into C. The error of the untyped call is kept as is, so
+// that an expired token still yields its authentication.
+func (service TypedService[C]) toTyped(authentication *Authentication, err error) (*TypedAuthentication[C], error) {
+	if authentication == nil {
+		return nil, err
+	}
+
+	typed := &TypedAuthentication[C]{Authentication: *authentication}
+	if len(authentication.Extra) > 0 {
+		encoded, marshalError := json.Marshal(authentication.Extra)
+		if marshalError != nil {
+			return nil, marshalError
+		}
+		if unmarshalError := json.Unmarshal(encoded, &typed.Claims); unmarshalError != nil {
+			return nil, unmarshalError
+		}
+	}
+
+	return typed, err
+}
+
+// toUntyped merges the custom claims into the extra claims of a copy of the authentication. Custom claims take
+// precedence over extra claims with the same name.
+func toUntyped[C any](authentication *TypedAuthentication[C]) (*Authentication, error) {
+	encoded, err := json.Marshal(authentication.Claims)
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(encoded, &claims); err != nil {
+		return nil, err
+	}
+
+	untyped := authentication.Authentication
+	untyped.Extra = make(map[string]interface{}, len(authentication.Extra)+len(claims))
+	for name, value := range authentication.Extra {
+		untyped.Extra[name] = value
+	}
+	for name, value := range claims {
+		untyped.Extra[name] = value
+	}
+
+	return &untyped, nil
+}
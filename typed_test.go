@@ -0,0 +1,88 @@
+package auth
+
+import (
+    "net/http"
+    "reflect"
+    "testing"
+)
+
+type tenantClaims struct {
+    TenantID string   `json:"tenantId"`
+    Locale   string   `json:"locale"`
+    Features []string `json:"features"`
+    // reserved claim names are ignored when signing
+    Subject string `json:"sub,omitempty"`
+}
+
+func TestTypedRoundTrip(t *testing.T) {
+    service := NewTyped[tenantClaims](Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+        JWTCookieName: "JWT",
+    })
+
+    authentication := &TypedAuthentication[tenantClaims]{
+        Authentication: Authentication{
+            ExpiresAt: expires2099,
+            IssuedAt:  issuedAt,
+            Subject:   "superadmin",
+            Name:      "Marty McFly",
+        },
+        Claims: tenantClaims{
+            TenantID: "hill-valley",
+            Locale:   "en-US",
+            Features: []string{"hoverboard"},
+            Subject:  "biff",
+        },
+    }
+
+    parsed, err := service.FromCookie(service.ToJWTCookie(authentication))
+
+    if err != nil {
+        t.Fatalf("Token should be valid, got %s", err)
+    }
+    if parsed.Subject != "superadmin" {
+        t.Errorf("Custom claims should not override reserved claims, got subject %s", parsed.Subject)
+    }
+    expectedClaims := tenantClaims{TenantID: "hill-valley", Locale: "en-US", Features: []string{"hoverboard"}}
+    if !reflect.DeepEqual(parsed.Claims, expectedClaims) {
+        t.Errorf("Expected claims %+v, got %+v", expectedClaims, parsed.Claims)
+    }
+}
+
+func TestTypedServiceMiddlewareAcceptsTypedToken(t *testing.T) {
+    service := NewTyped[tenantClaims](Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+        JWTCookieName: "JWT",
+    })
+    nextHandler := &nextHandler{}
+
+    req, rr := newRequestResponseEmulation(t)
+    req.AddCookie(service.ToJWTCookie(&TypedAuthentication[tenantClaims]{
+        Authentication: Authentication{
+            ExpiresAt:   expires2099,
+            Authorities: []GrantedAuthority{{Role: "ADMIN"}},
+        },
+        Claims: tenantClaims{TenantID: "hill-valley"},
+    }))
+
+    service.HasAnyRole("ADMIN")(nextHandler).ServeHTTP(rr, req)
+
+    if !nextHandler.Visited {
+        t.Error("Next handler should have been called for valid typed JWT token")
+    }
+}
+
+func TestTypedFromCookieKeepsExpiredAuthentication(t *testing.T) {
+    service := NewTyped[tenantClaims](Config{
+        JWTPrivateKey: []byte("privatesigningpassowrd"),
+    })
+
+    authentication, err := service.FromCookie(&http.Cookie{Value: expiredToken})
+
+    if authentication == nil || authentication.Name != "Marty McFly" {
+        t.Error("Expired token should still be interpreted")
+    }
+    if err == nil {
+        t.Error("Expired token should return an error")
+    }
+}
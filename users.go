@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// StoredUser is a user known to an InMemoryUsers verifier
+type StoredUser struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"passwordHash"`
+	// authentication returned on successful login
+	Authentication Authentication `json:"authentication"`
+}
+
+// InMemoryUsers is a CredentialVerifier for a fixed set of users. Password hashes created with outdated algorithms
+// or parameters are transparently replaced by hashes of the configured PasswordHasher on successful login.
+type InMemoryUsers struct {
+	// logger of failed rehashes. Defaults to slog.Default().
+	Logger *slog.Logger
+
+	hasher PasswordHasher
+	// called after a password has been rehashed, e.g. to persist the new hash
+	onRehash func(users []StoredUser) error
+	// serializes onRehash, so that an older list of users never overwrites a newer one
+	rehashMutex sync.Mutex
+
+	mutex sync.RWMutex
+	users map[string]StoredUser
+	// hash verified against for unknown users, so that they take as long as known ones
+	dummyHash string
+}
+
+// NewInMemoryUsers creates an empty InMemoryUsers hashing passwords with the given hasher
+func NewInMemoryUsers(hasher PasswordHasher) *InMemoryUsers {
+	dummyHash, _ := hasher.Hash("dummy password")
+	return &InMemoryUsers{
+		hasher:    hasher,
+		users:     map[string]StoredUser{},
+		dummyHash: dummyHash,
+	}
+}
+
+// NewFileUsers creates an InMemoryUsers from a JSON file holding a list of StoredUser. Rehashed passwords are
+// written back to the file.
+func NewFileUsers(path string, hasher PasswordHasher) (*InMemoryUsers, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read users file: %w", err)
+	}
+	var stored []StoredUser
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return nil, fmt.Errorf("unable to decode users file %s: %w", path, err)
+	}
+
+	users := NewInMemoryUsers(hasher)
+	for _, user := range stored {
+		users.AddHashed(user.Username, user.PasswordHash, user.Authentication)
+	}
+	users.onRehash = func(users []StoredUser) error {
+		return writeUsersFile(path, users)
+	}
+	return users, nil
+}
+
+// Add adds or replaces a user, hashing its password
+func (users *InMemoryUsers) Add(username, password string, authentication Authentication) error {
+	hash, err := users.hasher.Hash(password)
+	if err != nil {
+		return fmt.Errorf("unable to hash password: %w", err)
+	}
+	users.AddHashed(username, hash, authentication)
+	return nil
+}
+
+// AddHashed adds or replaces a user whose password has already been hashed
+func (users *InMemoryUsers) AddHashed(username, passwordHash string, authentication Authentication) {
+	users.mutex.Lock()
+	defer users.mutex.Unlock()
+	users.users[username] = StoredUser{
+		Username:       username,
+		PasswordHash:   passwordHash,
+		Authentication: authentication,
+	}
+}
+
+// Users lists all users, sorted by username
+func (users *InMemoryUsers) Users() []StoredUser {
+	users.mutex.RLock()
+	defer users.mutex.RUnlock()
+	list := make([]StoredUser, 0, len(users.users))
+	for _, user := range users.users {
+		list = append(list, user)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Username < list[j].Username
+	})
+	return list
+}
+
+// VerifyCredentials implements CredentialVerifier
+func (users *InMemoryUsers) VerifyCredentials(ctx context.Context, username, password string) (*Authentication, error) {
+	users.mutex.RLock()
+	user, found := users.users[username]
+	users.mutex.RUnlock()
+
+	if !found {
+		// spend the same time as for a known user, so that usernames can not be probed
+		_, _ = VerifyPassword(password, users.dummyHash)
+		return nil, ErrInvalidCredentials
+	}
+
+	ok, needsRehash, err := users.hasher.Verify(password, user.PasswordHash)
+	if err != nil {
+		return nil, fmt.Errorf("unable to verify password: %w", err)
+	}
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	if needsRehash {
+		// the password is correct, so a failed rehash must not prevent the login
+		if err := users.rehash(username, password, user.PasswordHash); err != nil {
+			logger := users.Logger
+			if logger == nil {
+				logger = slog.Default()
+			}
+			logger.ErrorContext(ctx, "Unable to rehash password", "username_hash", usernameHash(username), "error", err)
+		}
+	}
+
+	authentication := user.Authentication
+	return &authentication, nil
+}
+
+// --------------------------
+// private stuff
+// --------------------------
+
+// rehash replaces the hash of a user, unless it has been changed concurrently
+func (users *InMemoryUsers) rehash(username, password, oldHash string) error {
+	hash, err := users.hasher.Hash(password)
+	if err != nil {
+		return fmt.Errorf("unable to rehash password: %w", err)
+	}
+
+	users.mutex.Lock()
+	user, found := users.users[username]
+	if !found || user.PasswordHash != oldHash {
+		users.mutex.Unlock()
+		return nil
+	}
+	user.PasswordHash = hash
+	users.users[username] = user
+	users.mutex.Unlock()
+
+	if users.onRehash != nil {
+		// listed only once the former call is done, so that the last call stores all rehashed passwords
+		users.rehashMutex.Lock()
+		defer users.rehashMutex.Unlock()
+		if err := users.onRehash(users.Users()); err != nil {
+			return fmt.Errorf("unable to store rehashed password: %w", err)
+		}
+	}
+	return nil
+}
+
+// writeUsersFile replaces the users file atomically
+func writeUsersFile(path string, users []StoredUser) error {
+	content, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+
+	if _, err := temporary.Write(content); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Chmod(0600); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temporary.Name(), path)
+}